@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+// anyone can fail auth, so failures are recorded at most once per ip
+// and reason per interval, and writes for new keys are dropped while a
+// throttle tracks too many keys
+const (
+	authFailInterval      = 1 * time.Minute
+	auditThrottleMaxKeys  = 10000
+	auditRetentionDefault = 90 * 24 * time.Hour
+)
+
+var (
+	auditAuthOkThrottle   = newAuditThrottle(authUsageInterval)
+	auditAuthFailThrottle = newAuditThrottle(authFailInterval)
+)
+
+// how long audit events are kept, configured via env as
+// AUDIT_RETENTION=<duration>, ie 30d
+func auditRetention() time.Duration {
+	val := os.Getenv("AUDIT_RETENTION")
+	if val == "" {
+		return auditRetentionDefault
+	}
+	duration, err := exec.ParseDuration(val)
+	if err != nil {
+		panic(fmt.Sprintf("bad audit retention: %s", val))
+	}
+	return duration
+}
+
+// limits audit writes per key in this process
+type auditThrottle struct {
+	lock     sync.Mutex
+	last     map[string]time.Time
+	interval time.Duration
+}
+
+func newAuditThrottle(interval time.Duration) *auditThrottle {
+	return &auditThrottle{
+		last:     map[string]time.Time{},
+		interval: interval,
+	}
+}
+
+// whether to write an event for key now
+func (t *auditThrottle) allow(key string) bool {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.last[key]) < t.interval {
+		return false
+	}
+	if len(t.last) >= auditThrottleMaxKeys {
+		for k, last := range t.last {
+			if now.Sub(last) >= t.interval {
+				delete(t.last, k)
+			}
+		}
+		if len(t.last) >= auditThrottleMaxKeys {
+			return false
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+// record an audit event. failures are logged and never fail the
+// request, which may have already dispatched a job.
+func audit(ctx context.Context, event *exec.AuditEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			lib.Logger.Println("error: audit:", event.Action, r)
+		}
+	}()
+	err := auths.Audit(ctx, event)
+	if err != nil {
+		lib.Logger.Println("error: audit:", event.Action, err)
+	}
+}
+
+func auditRequest(event *Request) string {
+	return event.Method + " " + event.Path
+}
+
+// record successful auth, throttled per auth and ip in this process
+func auditAuthOk(ctx context.Context, event *Request, auth *Auth) {
+	ip := event.SourceIp
+	if !auditAuthOkThrottle.allow(auth.Name + " " + ip) {
+		return
+	}
+	e := exec.NewAuditEvent(exec.AuditAuthOk)
+	e.AuthName = auth.Name
+	e.Ip = ip
+	e.Request = auditRequest(event)
+	audit(ctx, e)
+}
+
+// record failed auth, throttled per ip and reason in this process
+func auditAuthFail(ctx context.Context, event *Request, reason error) {
+	if !auditAuthFailThrottle.allow(event.SourceIp + " " + reason.Error()) {
+		return
+	}
+	e := exec.NewAuditEvent(exec.AuditAuthFail)
+	e.Ip = event.SourceIp
+	e.Request = auditRequest(event)
+	e.Reason = reason.Error()
+	audit(ctx, e)
+}
+
+func auditJobSubmit(ctx context.Context, ip string, job *exec.AsyncEvent) {
+	e := exec.NewAuditEvent(exec.AuditJobSubmit)
+	e.AuthName = job.AuthName
+	e.Ip = ip
+	e.Uid = job.Uid
+	e.ParentUid = job.ParentUid
+	e.Argv = job.Argv
+	e.RpcName = job.RpcName
+	audit(ctx, e)
+}
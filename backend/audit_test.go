@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+func auditEvents(t *testing.T, action string) []exec.AuditEvent {
+	t.Helper()
+	events, err := auths.ListAudit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xs []exec.AuditEvent
+	for _, e := range events {
+		if e.Action == action {
+			xs = append(xs, e)
+		}
+	}
+	return xs
+}
+
+func TestAuditAuthFailThrottled(t *testing.T) {
+	h := newHarness(t)
+	h.auth = exec.RandKey()
+	for range 2 {
+		status, _ := h.api(http.MethodGet, "/api/jobs/missing", nil, nil)
+		if status != 401 {
+			t.Fatalf("bad auth: %d", status)
+		}
+	}
+	events := auditEvents(t, exec.AuditAuthFail)
+	if len(events) != 1 {
+		t.Fatalf("expected one auth-fail event, got %d", len(events))
+	}
+	expires := time.Unix(events[0].Expires, 0)
+	if time.Until(expires) < auditRetentionDefault-time.Minute || time.Until(expires) > auditRetentionDefault {
+		t.Fatalf("expires: %s", expires)
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	h := newHarness(t)
+	t.Setenv("AUDIT_RETENTION", "1h")
+	h.submit(&exec.PostRequest{
+		Argv: []string{"true"},
+	})
+	events := auditEvents(t, exec.AuditJobSubmit)
+	if len(events) != 1 {
+		t.Fatalf("expected one job-submit event, got %d", len(events))
+	}
+	if time.Until(time.Unix(events[0].Expires, 0)) > time.Hour {
+		t.Fatalf("expires: %d", events[0].Expires)
+	}
+	// expired events are swept like other records
+	events[0].Expires = time.Now().Add(-time.Second).Unix()
+	err := table.put(context.Background(), events[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweepExpired(context.Background())
+	if len(auditEvents(t, exec.AuditJobSubmit)) != 0 {
+		t.Fatal("expired audit event not swept")
+	}
+}
+
+// the audit store fails every write
+type failingAudit struct {
+	AuthStore
+}
+
+func (failingAudit) Audit(context.Context, *exec.AuditEvent) error {
+	return errors.New("audit outage")
+}
+
+// an audit outage never fails a submit, which has already dispatched
+// the job, since clients retry 5xx
+func TestAuditOutage(t *testing.T) {
+	h := newHarness(t)
+	auths = failingAudit{auths}
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"echo", "hi"},
+	})
+	if h.lambda.run() != 1 {
+		t.Fatal("expected one async invoke")
+	}
+	log, exit := h.poll(uid)
+	if log != "hi\n" || exit != 0 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+}
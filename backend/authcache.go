@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+// auth lookups are cached in process. revocation bumps the version
+// record, which is checked at most every authVersionInterval, and a
+// changed version drops every cached entry.
+const (
+	authCachePositiveTtl  = 30 * time.Second
+	authCacheNegativeTtl  = 5 * time.Second
+	authVersionInterval   = 5 * time.Second
+	authCacheStatInterval = 60 * time.Second
+)
+
+type authCacheEntry struct {
+	val     *tableRecord // nil when the record does not exist
+	expires time.Time
+}
+
+var authCache = &struct {
+	lock        sync.Mutex
+	entries     map[string]*authCacheEntry
+	version     int64
+	versionTime time.Time
+	hits        int
+	misses      int
+	statTime    time.Time
+}{
+	entries: map[string]*authCacheEntry{},
+}
+
+// get an auth record by id, via the cache when possible
+func lookupAuth(ctx context.Context, id string) (*exec.Record, bool) {
+	val, ok := cachedLookup(ctx, id, func() (*tableRecord, bool) {
+		val, ok, err := auths.Lookup(ctx, id)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			return nil, false
+		}
+		return &tableRecord{Record: *val}, true
+	})
+	if !ok {
+		return nil, false
+	}
+	return &val.Record, true
+}
+
+// get a session record by id, via the cache when possible
+func lookupSession(ctx context.Context, id string) (*tableRecord, bool) {
+	return cachedLookup(ctx, id, func() (*tableRecord, bool) {
+		val := &tableRecord{}
+		if !getRecord(ctx, id, val) {
+			return nil, false
+		}
+		return val, true
+	})
+}
+
+func cachedLookup(ctx context.Context, id string, fetch func() (*tableRecord, bool)) (*tableRecord, bool) {
+	checkAuthVersion(ctx)
+	now := time.Now()
+	authCache.lock.Lock()
+	entry, ok := authCache.entries[id]
+	if ok && now.Before(entry.expires) {
+		authCache.hits++
+		logAuthCacheStats(now)
+		authCache.lock.Unlock()
+		return entry.val, entry.val != nil
+	}
+	authCache.misses++
+	logAuthCacheStats(now)
+	authCache.lock.Unlock()
+	val, ok := fetch()
+	entry = &authCacheEntry{
+		expires: now.Add(authCacheNegativeTtl),
+	}
+	if ok {
+		entry.val = val
+		entry.expires = now.Add(authCachePositiveTtl)
+	}
+	authCache.lock.Lock()
+	authCache.entries[id] = entry
+	authCache.lock.Unlock()
+	return entry.val, ok
+}
+
+// drop a cached entry in this process
+func forgetAuth(id string) {
+	authCache.lock.Lock()
+	delete(authCache.entries, id)
+	authCache.lock.Unlock()
+}
+
+// drop the cache when the version record has changed
+func checkAuthVersion(ctx context.Context) {
+	authCache.lock.Lock()
+	if time.Since(authCache.versionTime) < authVersionInterval {
+		authCache.lock.Unlock()
+		return
+	}
+	authCache.versionTime = time.Now()
+	authCache.lock.Unlock()
+	val := exec.Record{}
+	_ = getRecord(ctx, exec.AuthVersionID, &val)
+	authCache.lock.Lock()
+	defer authCache.lock.Unlock()
+	if val.Version != authCache.version {
+		authCache.version = val.Version
+		authCache.entries = map[string]*authCacheEntry{}
+	}
+}
+
+// caller holds the lock
+func logAuthCacheStats(now time.Time) {
+	if now.Sub(authCache.statTime) < authCacheStatInterval {
+		return
+	}
+	authCache.statTime = now
+	total := authCache.hits + authCache.misses
+	lib.Logger.Printf("auth-cache hits=%d misses=%d hit-rate=%.2f\n", authCache.hits, authCache.misses, float64(authCache.hits)/float64(total))
+}
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// auth records, and the sign records that map the key id of signed
+// requests to them. dynamodb in lambda and a file in local mode.
+type AuthStore interface {
+	// create an auth record for key and its sign record, which holds the
+	// signing secret. the id is derived from key, and principal and
+	// created-at default when empty.
+	Create(ctx context.Context, key string, data exec.RecordData) (*exec.Record, error)
+
+	// get an auth record by id, ie auth.<blake2b32(key)>, returning
+	// false if it does not exist
+	Lookup(ctx context.Context, id string) (*exec.Record, bool, error)
+
+	// every auth record, ordered by id in local mode
+	List(ctx context.Context) ([]exec.Record, error)
+
+	// delete auth records and their sign records
+	Revoke(ctx context.Context, ids ...string) error
+
+	// overwrite auth records, ie to expire them
+	Update(ctx context.Context, records ...exec.Record) error
+
+	// record an event in the audit trail, expiring after the retention
+	Audit(ctx context.Context, event *exec.AuditEvent) error
+
+	// every audit event, ordered by id in local mode
+	ListAudit(ctx context.Context) ([]exec.AuditEvent, error)
+}
+
+var errAuthExists = errors.New("auth already exists")
+
+// the auth store of Serve when LOCAL_DIR is set, ie LOCAL_DIR=.aws-exec,
+// otherwise dynamodb. for cli commands.
+func NewAuthStore() AuthStore {
+	dir := os.Getenv("LOCAL_DIR")
+	if dir != "" {
+		return NewFileAuthStore(dir)
+	}
+	return NewDynamoAuthStore()
+}
+
+// the auth store over dynamodb, as used in lambda
+func NewDynamoAuthStore() AuthStore {
+	return tableAuthStore{table: dynamoTable{}}
+}
+
+// the auth store over the records file under dir, as used by Serve
+func NewFileAuthStore(dir string) AuthStore {
+	return tableAuthStore{table: newFileTable(localRecords(dir))}
+}
+
+func localRecords(dir string) string {
+	return filepath.Join(dir, "records.json")
+}
+
+// revoke and update bump the version record, which drops the auth
+// cache of every backend process
+type tableAuthStore struct {
+	table recordTable
+}
+
+func (s tableAuthStore) Create(ctx context.Context, key string, data exec.RecordData) (*exec.Record, error) {
+	id := "auth." + exec.Blake2b32(key)
+	if data.Principal == "" {
+		data.Principal = exec.Blake2b32(key)[:16]
+	}
+	if data.CreatedAt == 0 {
+		data.CreatedAt = time.Now().Unix()
+	}
+	record := &exec.Record{
+		RecordKey: exec.RecordKey{
+			ID: id,
+		},
+		RecordData: data,
+	}
+	sign := tableRecord{
+		Record: exec.Record{
+			RecordKey: exec.RecordKey{
+				ID: "sign." + exec.SignId(key),
+			},
+			RecordData: exec.RecordData{
+				Value:   id,
+				Expires: data.Expires,
+			},
+		},
+		Secret: exec.SignSecret(key),
+	}
+	for _, r := range []any{record, sign} {
+		ok, err := s.table.putIfNotExists(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errAuthExists
+		}
+	}
+	return record, nil
+}
+
+// the id of the sign record of an auth record
+func signIdForAuth(id string) string {
+	return "sign." + exec.Blake2b32(strings.TrimPrefix(id, "auth."))
+}
+
+func (s tableAuthStore) Lookup(ctx context.Context, id string) (*exec.Record, bool, error) {
+	val := &exec.Record{}
+	ok, err := s.table.get(ctx, id, val)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (s tableAuthStore) List(ctx context.Context) ([]exec.Record, error) {
+	var records []exec.Record
+	err := s.table.scan(ctx, "auth.", func(decode func(out any) error) error {
+		val := exec.Record{}
+		err := decode(&val)
+		if err != nil {
+			return err
+		}
+		records = append(records, val)
+		return nil
+	})
+	return records, err
+}
+
+func (s tableAuthStore) Revoke(ctx context.Context, ids ...string) error {
+	for _, id := range ids {
+		err := s.table.delete(ctx, signIdForAuth(id))
+		if err != nil {
+			return err
+		}
+		err = s.table.delete(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return s.table.bumpVersion(ctx, exec.AuthVersionID)
+}
+
+func (s tableAuthStore) Update(ctx context.Context, records ...exec.Record) error {
+	for _, record := range records {
+		err := s.table.put(ctx, record)
+		if err != nil {
+			return err
+		}
+		// the sign record expires with its auth record
+		sign := tableRecord{}
+		ok, err := s.table.get(ctx, signIdForAuth(record.ID), &sign)
+		if err != nil {
+			return err
+		}
+		if ok && sign.Expires != record.Expires {
+			sign.Expires = record.Expires
+			err = s.table.put(ctx, sign)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.table.bumpVersion(ctx, exec.AuthVersionID)
+}
+
+func (s tableAuthStore) Audit(ctx context.Context, event *exec.AuditEvent) error {
+	if event.Expires == 0 {
+		event.Expires = time.UnixMilli(event.Time).Add(auditRetention()).Unix()
+	}
+	ok, err := s.table.putIfNotExists(ctx, event)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("audit id collision: " + event.ID)
+	}
+	return nil
+}
+
+func (s tableAuthStore) ListAudit(ctx context.Context) ([]exec.AuditEvent, error) {
+	var events []exec.AuditEvent
+	err := s.table.scan(ctx, "audit.", func(decode func(out any) error) error {
+		val := exec.AuditEvent{}
+		err := decode(&val)
+		if err != nil {
+			return err
+		}
+		if expired(val.Expires) {
+			return nil // ttl deletes are not immediate
+		}
+		events = append(events, val)
+		return nil
+	})
+	return events, err
+}
@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// sign records expire with their auth record, so ttl deletes them together
+func TestSignRecordExpires(t *testing.T) {
+	newHarness(t)
+	ctx := context.Background()
+	key := exec.RandKey()
+	record, err := auths.Create(ctx, key, exec.RecordData{Value: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Expires = time.Now().Add(-time.Second).Unix()
+	err = auths.Update(ctx, *record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := tableRecord{}
+	if !getRecord(ctx, "sign."+exec.SignId(key), &sign) || sign.Expires != record.Expires {
+		t.Fatalf("sign record: %#v", sign)
+	}
+	sweepExpired(ctx)
+	if getRecord(ctx, record.ID, &exec.Record{}) || getRecord(ctx, "sign."+exec.SignId(key), &sign) {
+		t.Fatal("expired auth not swept")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -23,20 +24,24 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	sdkLambda "github.com/aws/aws-sdk-go-v2/service/lambda"
-	sdkLambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/dustin/go-humanize"
 	uuid "github.com/gofrs/uuid"
 	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
 	"github.com/nathants/libaws/lib"
 )
 
-func index() events.APIGatewayProxyResponse {
+// where jobs and records are kept and how async events run. aws in
+// lambda, local files and goroutines via Serve().
+var (
+	objects    store.Store = store.NewS3(os.Getenv("PROJECT_BUCKET"))
+	table      recordTable = dynamoTable{}
+	auths      AuthStore   = tableAuthStore{table: table}
+	dispatcher Dispatcher  // nil is configured via env, see jobDispatcher()
+)
+
+func index() Response {
 	headers := map[string]string{
 		"Content-Type":               "text/html; charset=UTF-8",
 		"Content-Security-Policy":    "frame-ancestors 'none'; object-src 'none'; base-uri 'none';",
@@ -54,7 +59,7 @@ func index() events.APIGatewayProxyResponse {
 			panic(err)
 		}
 	}
-	return events.APIGatewayProxyResponse{
+	return Response{
 		Body:            base64.StdEncoding.EncodeToString(indexBytes),
 		IsBase64Encoded: true,
 		StatusCode:      200,
@@ -62,10 +67,10 @@ func index() events.APIGatewayProxyResponse {
 	}
 }
 
-func static(path string) events.APIGatewayProxyResponse {
+func static(path string) Response {
 	data, err := os.ReadFile("frontend/public" + path)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
+		return Response{
 			StatusCode: 404,
 		}
 	}
@@ -89,7 +94,7 @@ func static(path string) events.APIGatewayProxyResponse {
 	} else {
 		body = base64.StdEncoding.EncodeToString(data)
 	}
-	return events.APIGatewayProxyResponse{
+	return Response{
 		Body:            body,
 		IsBase64Encoded: true,
 		StatusCode:      200,
@@ -101,203 +106,242 @@ func last(xs []string) string {
 	return xs[len(xs)-1]
 }
 
-func notfound() events.APIGatewayProxyResponse {
-	return events.APIGatewayProxyResponse{
+func notfound() Response {
+	return Response{
 		Body:       "404",
 		StatusCode: 404,
 	}
 }
 
-func checkAuth(ctx context.Context, auth string) (string, bool) {
-	key, err := attributevalue.MarshalMap(exec.RecordKey{
-		ID: fmt.Sprintf("auth.%s", exec.Blake2b32(auth)),
+func init() {
+	Handle(&Route{
+		Method:  http.MethodPost,
+		Pattern: "/api/login",
+		Handler: httpLoginPost,
+		Public:  true,
 	})
-	if err != nil {
-		panic(err)
-	}
-	table := os.Getenv("PROJECT_NAME")
-	var out *dynamodb.GetItemOutput
-	err = lib.Retry(ctx, func() error {
-		var err error
-		out, err = lib.DynamoDBClient().GetItem(ctx, &dynamodb.GetItemInput{
-			TableName:      aws.String(table),
-			ConsistentRead: aws.Bool(true),
-			Key:            key,
-		})
-		return err
+	Handle(&Route{
+		Method:  http.MethodPost,
+		Pattern: "/api/logout",
+		Handler: httpLogoutPost,
 	})
-	if err != nil {
-		panic(err)
-	}
-	if out.Item == nil {
-		return "", false
+	Handle(&Route{
+		Method:     http.MethodGet,
+		Pattern:    "/api/exec",
+		Handler:    JSON(httpExecGet),
+		Scope:      exec.ScopeJobsRead,
+		Middleware: []RouteMiddleware{rateLimitMiddleware(ratePoll)},
+	})
+	Handle(&Route{
+		Method:     http.MethodPost,
+		Pattern:    "/api/exec",
+		Handler:    JSON(httpExecPost), // scope depends on the body
+		Middleware: []RouteMiddleware{rateLimitMiddleware(rateSubmit)},
+	})
+	Handle(&Route{
+		Method:     http.MethodGet,
+		Pattern:    "/api/jobs/{uid}",
+		Handler:    JSON(httpJobGet),
+		Scope:      exec.ScopeJobsRead,
+		Middleware: []RouteMiddleware{rateLimitMiddleware(ratePoll)},
+	})
+}
+
+var (
+	errAuthInvalid = errors.New("invalid auth")
+	errAuthExpired = errors.New("expired auth")
+)
+
+// an authenticated caller
+type Auth struct {
+	Name    string // prefix for jobs owned by this caller
+	Scopes  []string
+	Expires int64 // unix seconds, zero never expires
+	id      string
+}
+
+func (a *Auth) HasScope(scope string) bool {
+	return exec.HasScope(a.Scopes, scope)
+}
+
+// usage is written at most once per interval per auth
+const authUsageInterval = 5 * time.Minute
+
+var (
+	authUsageLock = &sync.Mutex{}
+	authUsage     = map[string]time.Time{}
+)
+
+func checkAuth(ctx context.Context, auth, ip string) (*Auth, error) {
+	val, ok := lookupAuth(ctx, fmt.Sprintf("auth.%s", exec.Blake2b32(auth)))
+	if !ok || val.Value == "" {
+		return nil, errAuthInvalid
 	}
-	val := exec.Record{}
-	err = attributevalue.UnmarshalMap(out.Item, &val)
-	if err != nil {
-		panic(err)
+	if expired(val.Expires) {
+		return nil, errAuthExpired
 	}
-	if val.Value == "" {
-		return "", false
+	recordAuthUsage(ctx, val, ip)
+	return newAuth(val), nil
+}
+
+func newAuth(val *exec.Record) *Auth {
+	return &Auth{
+		Name:    val.AuthName(),
+		Scopes:  val.Scopes,
+		Expires: val.Expires,
+		id:      val.ID,
 	}
-	return val.Value + ":" + val.ID[5:21], true
 }
 
-func httpExecGet(ctx context.Context, event *events.APIGatewayProxyRequest, res chan<- events.APIGatewayProxyResponse, authName string) {
-	bucket := os.Getenv("PROJECT_BUCKET")
-	getRequest := exec.GetRequest{
-		Uid:        event.QueryStringParameters["uid"],
-		RangeStart: atoi(event.QueryStringParameters["range-start"]),
+// record last-used-at and last-ip, throttled both in this process and
+// across processes by the last-used-at already on the record
+func recordAuthUsage(ctx context.Context, val *exec.Record, ip string) {
+	now := time.Now()
+	threshold := now.Add(-authUsageInterval)
+	if time.Unix(val.LastUsedAt, 0).After(threshold) {
+		return
 	}
-	headers := map[string]string{
-		"auth-name":    authName,
-		"uid":          getRequest.Uid,
-		"Content-Type": "application/json",
+	authUsageLock.Lock()
+	if authUsage[val.ID].After(threshold) {
+		authUsageLock.Unlock()
+		return
+	}
+	authUsage[val.ID] = now
+	authUsageLock.Unlock()
+	touchRecord(ctx, val.ID, ip, now.Unix(), threshold.Unix())
+}
+
+func httpExecGet(ctx context.Context, auth *Auth, getRequest *exec.GetRequest) (*exec.GetResponse, error) {
+	authName := auth.Name
+	SetHeader(ctx, "uid", getRequest.Uid)
+	job := store.Job(authName, getRequest.Uid)
+	var progress *exec.JobProgress
+	held := false
+	meta := getMeta(ctx, job.Meta())
+	if meta != nil {
+		progress = meta.Progress
+		held = meta.Started == 0 && meta.HeldSince != 0
 	}
-	sizeKey := fmt.Sprintf("jobs/%s/%s/size", authName, getRequest.Uid)
-	exitKey := fmt.Sprintf("jobs/%s/%s/exit", authName, getRequest.Uid)
-	logKey := fmt.Sprintf("jobs/%s/%s/log.txt", authName, getRequest.Uid)
 	// once size is known and client has read size bytes, return exit
-	outSize, err := lib.S3Client().GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(sizeKey),
-	})
+	sizeData, err := objects.Get(ctx, job.Size())
 	if err == nil {
-		sizeData, err := io.ReadAll(outSize.Body)
-		if err != nil {
-			panic(err)
-		}
-		err = outSize.Body.Close()
-		if err != nil {
-			panic(err)
-		}
 		size := atoi(string(sizeData))
+		if getRequest.RangeStart > size {
+			return nil, BadRequest("range-start %d is past the log size %d", getRequest.RangeStart, size)
+		}
 		if getRequest.RangeStart == size {
-			outExit, err := lib.S3Client().GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(exitKey),
-			})
-			if err != nil {
-				panic(err)
-			}
-			exitData, err := io.ReadAll(outExit.Body)
-			if err != nil {
-				panic(err)
-			}
-			err = outExit.Body.Close()
+			exitData, err := objects.Get(ctx, job.Exit())
 			if err != nil {
 				panic(err)
 			}
 			exit := atoi(string(exitData))
-			respData, err := json.Marshal(exec.GetResponse{
-				Exit: aws.Int(exit),
-			})
-			if err != nil {
-				panic(err)
-			}
-			res <- events.APIGatewayProxyResponse{
-				StatusCode: 200,
-				Body:       string(respData),
-				Headers:    headers,
-			}
-			return
+			return &exec.GetResponse{
+				Exit:     aws.Int(exit),
+				Progress: progress,
+			}, nil
 		}
 	}
-	// otherwise return presigned s3 url for range-start
-	rangeHeader := fmt.Sprintf("bytes=%d-", getRequest.RangeStart)
-	presignClient := s3.NewPresignClient(lib.S3Client())
-	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(logKey),
-		Range:  aws.String(rangeHeader),
-	}, s3.WithPresignExpires(60*time.Second))
+	// otherwise return presigned url for range-start
+	url, err := objects.Presign(ctx, job.Log(), 60*time.Second)
 	if err != nil {
 		panic(err)
 	}
-	url := req.URL
-	respData, err := json.Marshal(exec.GetResponse{
-		Url: url,
-	})
+	return &exec.GetResponse{
+		Url:      url,
+		Progress: progress,
+		Held:     held,
+	}, nil
+}
+
+func putMeta(ctx context.Context, key string, meta *exec.JobMeta) {
+	data, err := json.Marshal(meta)
 	if err != nil {
 		panic(err)
 	}
-	res <- events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Body:       string(respData),
-		Headers:    headers,
+	err = lib.Retry(ctx, func() error {
+		return objects.Put(ctx, key, bytes.NewReader(data))
+	})
+	if err != nil {
+		panic(err)
 	}
 }
 
-func httpExecPost(ctx context.Context, event *events.APIGatewayProxyRequest, res chan<- events.APIGatewayProxyResponse, authName string) {
-	postRequest := exec.PostRequest{}
-	if event.IsBase64Encoded {
-		data, err := base64.StdEncoding.DecodeString(event.Body)
-		if err != nil {
-			panic(err)
-		}
-		event.Body = string(data)
+func getMeta(ctx context.Context, key string) *exec.JobMeta {
+	data, err := objects.Get(ctx, key)
+	if err != nil {
+		return nil
 	}
-	err := json.Unmarshal([]byte(event.Body), &postRequest)
+	meta := &exec.JobMeta{}
+	err = json.Unmarshal(data, meta)
 	if err != nil {
-		panic(fmt.Sprint(event.Body, err))
+		panic(err)
 	}
+	return meta
+}
+
+type jobGetRequest struct {
+	Uid string `json:"uid"`
+}
+
+// job metadata, ie progress and result
+func httpJobGet(ctx context.Context, auth *Auth, req *jobGetRequest) (*exec.JobMeta, error) {
+	SetHeader(ctx, "uid", req.Uid)
+	meta := getMeta(ctx, store.Job(auth.Name, req.Uid).Meta())
+	if meta == nil {
+		return nil, NotFound("no such job: %s", req.Uid)
+	}
+	return meta, nil
+}
+
+func httpExecPost(ctx context.Context, auth *Auth, postRequest *exec.PostRequest) (*exec.PostResponse, error) {
+	authName := auth.Name
 	_, ok := exec.Rpc[postRequest.RpcName]
 	if !ok && postRequest.RpcName != "" {
-		res <- events.APIGatewayProxyResponse{
-			StatusCode: 404,
-		}
-		return
+		return nil, NotFound("no such rpc: %s", postRequest.RpcName)
 	}
-	uid := fmt.Sprintf("%d.%s", time.Now().Unix(), uuid.Must(uuid.NewV4()).String())
-	data, err := json.Marshal(exec.AsyncEvent{
+	scope := exec.ScopeExecArgv
+	if postRequest.RpcName != "" {
+		scope = exec.ScopeRpcPrefix + postRequest.RpcName
+	}
+	if !auth.HasScope(scope) {
+		return nil, Forbidden("missing scope: %s", scope)
+	}
+	quota := jobQuota()
+	if quota > 0 && !jobQuotaHold() && activeLeases(ctx, authName) >= quota {
+		return nil, QuotaExceeded("job quota exceeded, %d jobs running", quota)
+	}
+	uid := newUid()
+	job := &exec.AsyncEvent{
 		EventType: exec.EventExec,
 		Uid:       uid,
 		AuthName:  authName,
+		Scopes:    auth.Scopes,
 		PushUrls:  postRequest.PushUrls,
 		Argv:      postRequest.Argv,
 		RpcName:   postRequest.RpcName,
 		RpcArgs:   postRequest.RpcArgs,
-	})
-	if err != nil {
-		panic(err)
-	}
-	headers := map[string]string{
-		"auth-name":    authName,
-		"uid":          uid,
-		"Content-Type": "application/json",
 	}
-	err = lib.Retry(ctx, func() error {
-		out, err := lib.LambdaClient().Invoke(ctx, &sdkLambda.InvokeInput{
-			FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
-			InvocationType: sdkLambdaTypes.InvocationTypeEvent,
-			LogType:        sdkLambdaTypes.LogTypeNone,
-			Payload:        data,
-		})
-		if err != nil {
-			return err
-		}
-		if out.StatusCode != 202 {
-			return fmt.Errorf("status %d", out.StatusCode)
-		}
-		return nil
-	})
-	if err != nil {
-		panic(err)
-	}
-	data, err = json.Marshal(exec.PostResponse{
+	invokeAsync(ctx, job)
+	auditJobSubmit(ctx, sourceIp(ctx), job)
+	SetHeader(ctx, "uid", uid)
+	return &exec.PostResponse{
 		Uid: uid,
-	})
+	}, nil
+}
+
+func newUid() string {
+	return fmt.Sprintf("%d.%s", time.Now().Unix(), uuid.Must(uuid.NewV4()).String())
+}
+
+// run handleAsyncEvent for the event via the job dispatcher
+func invokeAsync(ctx context.Context, event *exec.AsyncEvent) {
+	err := jobDispatcher().Dispatch(ctx, event)
 	if err != nil {
 		panic(err)
 	}
-	res <- events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Body:       string(data),
-		Headers:    headers,
-	}
 }
 
-func httpVersionGet(_ context.Context, _ *events.APIGatewayProxyRequest, res chan<- events.APIGatewayProxyResponse) {
+func httpVersionGet(_ context.Context, _ *Request, res chan<- Response) {
 	val := map[string]string{}
 	err := filepath.Walk(".", func(file string, _ os.FileInfo, err error) error {
 		if err != nil {
@@ -327,13 +371,13 @@ func httpVersionGet(_ context.Context, _ *events.APIGatewayProxyRequest, res cha
 	if err != nil {
 		panic(err)
 	}
-	res <- events.APIGatewayProxyResponse{
+	res <- Response{
 		StatusCode: 200,
 		Body:       string(data),
 	}
 }
 
-func handleApiEvent(ctx context.Context, event *events.APIGatewayProxyRequest, res chan<- events.APIGatewayProxyResponse) {
+func handleApiEvent(ctx context.Context, event *Request, res chan<- Response) {
 	if event.Path == "/" {
 		res <- index()
 		return
@@ -348,36 +392,62 @@ func handleApiEvent(ctx context.Context, event *events.APIGatewayProxyRequest, r
 		return
 	}
 	if strings.HasPrefix(event.Path, "/api/") {
-		if event.HTTPMethod == http.MethodOptions {
-			res <- events.APIGatewayProxyResponse{
+		if event.Method == http.MethodOptions {
+			res <- Response{
 				StatusCode: 200,
 			}
 			return
 		}
-		auth, ok := exec.CaseInsensitiveGet(event.Headers, "auth")
-		if !ok {
-			res <- unauthorized()
+		route, params, allowed := matchRoute(event.Method, event.Path)
+		if route != nil && route.Public {
+			event.PathParameters = params
+			route.handler()(ctx, event, res, nil)
 			return
 		}
-		authName, ok := checkAuth(ctx, auth)
-		if !ok {
-			res <- unauthorized()
+		// authenticate before answering 404 or 405, so routes cannot be
+		// enumerated without auth
+		var authInfo *Auth
+		var err error
+		ip := event.SourceIp
+		_, signed := exec.CaseInsensitiveGet(event.Headers, exec.HeaderSignature)
+		auth, hasAuth := exec.CaseInsensitiveGet(event.Headers, "auth")
+		bearer, hasBearer := bearerToken(event.Headers)
+		token, hasSession := sessionToken(event)
+		switch {
+		case signed:
+			authInfo, err = checkSignature(ctx, event, ip)
+		case hasAuth:
+			authInfo, err = checkAuth(ctx, auth, ip)
+		case hasBearer && oidcEnabled():
+			authInfo, err = checkBearer(ctx, bearer)
+		case hasSession:
+			authInfo, err = checkSession(ctx, event, token, ip)
+		default:
+			err = errAuthInvalid
+		}
+		if err != nil {
+			auditAuthFail(ctx, event, err)
+		} else {
+			auditAuthOk(ctx, event, authInfo)
+		}
+		if errors.Is(err, errCsrfInvalid) {
+			res <- errorResponse(Forbidden("%s", err))
 			return
 		}
-		switch event.Path {
-		case "/api/exec":
-			switch event.HTTPMethod {
-			case http.MethodGet:
-				httpExecGet(ctx, event, res, authName)
-				return
-			case http.MethodPost:
-				httpExecPost(ctx, event, res, authName)
+		if err != nil {
+			res <- unauthorized(err)
+			return
+		}
+		if route == nil {
+			if len(allowed) > 0 {
+				res <- methodNotAllowed(allowed)
 				return
-			default:
 			}
-		default:
+			res <- errorResponse(NotFound("no such route: %s %s", event.Method, event.Path))
+			return
 		}
-		res <- notfound()
+		event.PathParameters = params
+		route.handler()(ctx, event, res, authInfo)
 		return
 	}
 	res <- notfound()
@@ -391,32 +461,88 @@ func atoi(x string) int {
 	return n
 }
 
-func unauthorized() events.APIGatewayProxyResponse {
+func unauthorized(reason error) Response {
 	time.Sleep(1 * time.Second)
-	return events.APIGatewayProxyResponse{
-		StatusCode: 401,
-	}
+	return errorResponse(&HttpError{
+		Status:  http.StatusUnauthorized,
+		Code:    exec.ErrorCodeUnauthorized,
+		Message: reason.Error(),
+	})
 }
 
-func logRecover(r any, res chan<- events.APIGatewayProxyResponse) {
+// log a panic with its stack, keyed by request id, and return a 500
+// that carries only the request id
+func logRecover(ctx context.Context, r any, res chan<- Response) {
 	stack := string(debug.Stack())
-	lib.Logger.Println(r)
+	id := RequestId(ctx)
+	lib.Logger.Println("panic", id, r)
 	lib.Logger.Println(stack)
-	res <- events.APIGatewayProxyResponse{
-		StatusCode: 500,
-		Body:       fmt.Sprint(r) + "\n" + stack,
-	}
+	res <- errorResponse(&HttpError{
+		Status:  http.StatusInternalServerError,
+		Code:    exec.ErrorCodeServerError,
+		Message: "internal error, request-id: " + id,
+	})
 }
 
 // invoke a command via subprocess or rpc, shipping results to s3 via size, exit, and log objects
-func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- events.APIGatewayProxyResponse) {
-	bucket := os.Getenv("PROJECT_BUCKET")
+func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- Response) {
+	// take a lease for this job, failing or holding it when over quota
+	quotaErr := ""
+	leased := false
+	quota := jobQuota()
+	if quota > 0 && event.ParentUid == "" {
+		if acquireLease(ctx, event.AuthName, event.Uid, quota) {
+			leased = true
+			defer func() {
+				if leased { // on panic
+					releaseLease(ctx, event.AuthName, event.Uid)
+				}
+			}()
+		} else if jobQuotaHold() && holdJob(ctx, event) {
+			res <- Response{
+				Body:       "held",
+				StatusCode: 200,
+			}
+			return
+		} else {
+			quotaErr = fmt.Sprintf("job quota exceeded, %d jobs running", quota)
+		}
+	}
+
 	start := time.Now()
 	exitCode := 0
 	lines := make(chan *string, 128)
 	logsDone := make(chan error)
 	logFileSize := 0
 
+	// job metadata, updated when an rpc reports progress
+	job := store.Job(event.AuthName, event.Uid)
+	metaLock := &sync.Mutex{}
+	metaDirty := true
+	meta := &exec.JobMeta{
+		Uid:       event.Uid,
+		AuthName:  event.AuthName,
+		Argv:      event.Argv,
+		RpcName:   event.RpcName,
+		ParentUid: event.ParentUid,
+		Started:   start.Unix(),
+	}
+	shipMeta := func() {
+		if event.PushUrls != nil {
+			return // metadata is only persisted to the internal bucket
+		}
+		metaLock.Lock()
+		if !metaDirty {
+			metaLock.Unlock()
+			return
+		}
+		metaDirty = false
+		snapshot := *meta
+		metaLock.Unlock()
+		putMeta(ctx, job.Meta(), &snapshot)
+	}
+	shipMeta()
+
 	// follow an output stream, ie stdout or stderr
 	follow := func(r io.ReadCloser) {
 		// defer func() {}()
@@ -436,16 +562,15 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				logRecover(r, res)
+				logRecover(ctx, r, res)
 			}
 		}()
 		logToDisk := true
 		doneCount := 0
 		lastShippedTime := time.Now()
 		lastShippedSize := 0
-		logKey := fmt.Sprintf("jobs/%s/%s/log.txt", event.AuthName, event.Uid)
 		logLock := &sync.RWMutex{}
-		logFilePath := "/tmp/log.txt"
+		logFilePath := filepath.Join(os.TempDir(), "aws-exec."+event.Uid+".log") // per uid, since local mode runs jobs concurrently
 		_ = os.Remove(logFilePath)
 		logFile, err := os.Create(logFilePath)
 		if err != nil {
@@ -453,11 +578,13 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 		}
 		defer func() {
 			_ = logFile.Close()
+			_ = os.Remove(logFilePath)
 		}()
 		logFileWriter := bufio.NewWriter(logFile)
 
 		// log shipping func
 		shipLogs := func() {
+			shipMeta()
 			err = lib.Retry(ctx, func() error {
 				logLock.Lock()
 				err := logFileWriter.Flush()
@@ -494,7 +621,7 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 					go func() {
 						defer func() {
 							if r := recover(); r != nil {
-								logRecover(r, res)
+								logRecover(ctx, r, res)
 							}
 						}()
 						_, copyErr := io.CopyN(pw, r, int64(size))
@@ -525,13 +652,8 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 					return nil
 				}
 
-				// or ship logs to internal bucket
-				_, err = lib.S3Client().PutObject(ctx, &s3.PutObjectInput{
-					Bucket: aws.String(bucket),
-					Key:    aws.String(logKey),
-					Body:   r,
-				})
-				return err
+				// or ship logs to internal store
+				return objects.Put(ctx, job.Log(), r)
 			})
 			if err != nil {
 				panic(err)
@@ -561,10 +683,11 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 					val := *line + "\n"
 					if logFileSize >= exec.MaxLogBytes {
 						if logToDisk {
-							_, err = logFileWriter.WriteString("[log truncated]\n")
+							n, err := logFileWriter.WriteString("[log truncated]\n")
 							if err != nil {
 								panic(err)
 							}
+							logFileSize += n // size is the length of the final log, including this line
 							logToDisk = false
 						}
 					} else {
@@ -586,15 +709,40 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 		}
 	}()
 
-	if event.RpcName != "" {
+	if quotaErr != "" {
+
+		// fail without running the command
+		lines <- aws.String("error: " + quotaErr)
+		lines <- nil
+		lines <- nil
+		lines <- nil
+		<-logsDone
+		exitCode = 1
+
+	} else if event.RpcName != "" {
 
 		// invoke command via rpc
 		ctx, cancel := context.WithTimeout(ctx, 14*time.Minute)
 		defer cancel()
+		ctx = exec.WithProgress(ctx, func(progress *exec.JobProgress) {
+			metaLock.Lock()
+			defer metaLock.Unlock()
+			meta.Progress = progress
+			metaDirty = true
+		})
+		ctx = exec.WithResult(ctx, func(result string) {
+			metaLock.Lock()
+			defer metaLock.Unlock()
+			meta.Result = result
+			metaDirty = true
+		})
 		pr, pw := io.Pipe()
 		go follow(pr)
 		bw := bufio.NewWriter(pw)
+		printLock := &sync.Mutex{}
 		println := func(v ...any) {
+			printLock.Lock()
+			defer printLock.Unlock()
 			var xs []string
 			for _, x := range v {
 				xs = append(xs, fmt.Sprint(x))
@@ -608,26 +756,24 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 				panic(err)
 			}
 		}
-		fn, ok := exec.Rpc[event.RpcName]
-		if !ok {
-			panic(event.RpcName)
+		ctx = exec.WithFanout(ctx, fanout(event, println))
+		err := exec.CallRpc(ctx, &exec.RpcCall{
+			Name:     event.RpcName,
+			ArgsJson: event.RpcArgs,
+			AuthName: event.AuthName,
+			Uid:      event.Uid,
+			Println:  println,
+		})
+		var rpcPanic *exec.RpcPanic
+		if errors.As(err, &rpcPanic) {
+			lines <- aws.String(fmt.Sprint(rpcPanic.Value))
+			lines <- aws.String(rpcPanic.Stack)
+			exitCode = 1
+		} else if err != nil {
+			println("error:", err)
+			exitCode = 1
 		}
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					stack := string(debug.Stack())
-					lines <- aws.String(fmt.Sprint(r))
-					lines <- aws.String(stack)
-					exitCode = 1
-				}
-			}()
-			err := fn(ctx, println, event.RpcArgs)
-			if err != nil {
-				println("error:", err)
-				exitCode = 1
-			}
-		}()
-		err := bw.Flush()
+		err = bw.Flush()
 		if err != nil {
 			panic(err)
 		}
@@ -672,7 +818,8 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 		err = cmd.Start()
 		if err != nil {
 			lines <- aws.String(fmt.Sprintf("error: %s", err))
-			lines <- nil
+			lines <- nil // stdout and stderr are closed by cmd.Start() on error
+			<-logsDone
 			exitCode = 1
 		} else {
 			lines <- nil
@@ -732,34 +879,28 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 
 	} else {
 
-		// ship size and exit to internal bucket
-		exitKey := fmt.Sprintf("jobs/%s/%s/exit", event.AuthName, event.Uid)
+		// ship size and exit to internal store
 		err := lib.Retry(ctx, func() error {
-			_, err := lib.S3Client().PutObject(ctx, &s3.PutObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(exitKey),
-				Body:   bytes.NewReader([]byte(fmt.Sprint(exitCode))),
-			})
-			return err
+			return objects.Put(ctx, job.Exit(), bytes.NewReader([]byte(fmt.Sprint(exitCode))))
 		})
 		if err != nil {
 			panic(err)
 		}
-		sizeKey := fmt.Sprintf("jobs/%s/%s/size", event.AuthName, event.Uid)
 		err = lib.Retry(ctx, func() error {
-			_, err := lib.S3Client().PutObject(ctx, &s3.PutObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(sizeKey),
-				Body:   bytes.NewReader([]byte(fmt.Sprint(logFileSize))),
-			})
-			return err
+			return objects.Put(ctx, job.Size(), bytes.NewReader([]byte(fmt.Sprint(logFileSize))))
 		})
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	res <- events.APIGatewayProxyResponse{
+	// release before responding, since lambda can freeze once it responds
+	if leased {
+		releaseLease(ctx, event.AuthName, event.Uid)
+		leased = false
+	}
+
+	res <- Response{
 		Body:       "ok",
 		StatusCode: 200,
 		Headers: map[string]string{
@@ -769,10 +910,20 @@ func handleAsyncEvent(ctx context.Context, event *exec.AsyncEvent, res chan<- ev
 	}
 }
 
-func handle(ctx context.Context, event map[string]any, res chan<- events.APIGatewayProxyResponse) {
+// invoked every 5 minutes by the schedule trigger
+func handleScheduledEvent(ctx context.Context, res chan<- Response) {
+	sweepLeases(ctx)
+	sweepExpired(ctx)
+	res <- Response{
+		Body:       "ok",
+		StatusCode: 200,
+	}
+}
+
+func handle(ctx context.Context, event map[string]any, req *Request, res chan<- Response) {
 	defer func() {
 		if r := recover(); r != nil {
-			logRecover(r, res)
+			logRecover(ctx, r, res)
 		}
 	}()
 	if event["event-type"] == exec.EventExec {
@@ -788,68 +939,136 @@ func handle(ctx context.Context, event map[string]any, res chan<- events.APIGate
 		handleAsyncEvent(ctx, asyncEvent, res)
 		return
 	}
-	_, ok := event["path"]
-	if !ok {
-		res <- notfound()
+	if event["detail-type"] == "Scheduled Event" {
+		handleScheduledEvent(ctx, res)
 		return
 	}
-	apiEvent := &events.APIGatewayProxyRequest{}
-	data, err := json.Marshal(event)
-	if err != nil {
-		panic(err)
+	if isSqsEvent(event) {
+		handleSqsEvent(ctx, event, res)
+		return
 	}
-	err = json.Unmarshal(data, &apiEvent)
-	if err != nil {
-		panic(err)
+	if req == nil {
+		res <- notfound()
+		return
 	}
-	handleApiEvent(ctx, apiEvent, res)
+	handleApiEvent(ctx, req, res)
 }
 
 func timestamp() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
 
-func HandleRequest(ctx context.Context, event map[string]any) (events.APIGatewayProxyResponse, error) {
+// parse the env config, panicking on bad values, so a misconfigured
+// deploy fails on start instead of on every request that reads it
+func CheckConfig() {
+	jobDispatcher()
+	jobQuota()
+	jobQuotaHold()
+	jobQuotaHoldMax()
+	rateLimitConfig(rateSubmit)
+	rateLimitConfig(ratePoll)
+	auditRetention()
+}
+
+func HandleRequest(ctx context.Context, event map[string]any) (any, error) {
 	setupLogging(ctx)
 	defer lib.Logger.Flush()
+	return handleEvent(ctx, event), nil
+}
+
+// handle an event of any kind, returning the encoded response
+func handleEvent(ctx context.Context, event map[string]any) any {
+	req, isApi := parseRequest(event)
+	if isApi {
+		return handleApiRequest(ctx, newRequestId(event), req).encode(req.format)
+	}
 	start := time.Now()
-	res := make(chan events.APIGatewayProxyResponse)
-	go handle(ctx, event, res)
+	id := newRequestId(event)
+	ctx = withRequestId(ctx, id)
+	res := make(chan Response)
+	go handle(ctx, event, nil, res)
 	r := <-res
-	path, ok := event["path"]
-	if ok {
-		uid := r.Headers["uid"]
-		if uid == "" {
-			uid = "-"
-		}
-		authName := r.Headers["auth-name"]
-		if authName == "" {
-			authName = "-"
+	if r.Headers == nil {
+		r.Headers = map[string]string{}
+	}
+	r.Headers[exec.HeaderRequestId] = id
+	uid, ok := event["uid"].(string)
+	if !ok {
+		uid = "-"
+	}
+	authName, ok := event["auth-name"].(string)
+	if !ok {
+		authName = "-"
+	}
+	eventType, ok := event["event-type"].(string) // our event
+	if !ok {
+		_, ok = event["detail-type"].(string) // aws scheduled event
+		switch {
+		case ok:
+			eventType = "scheduled-event"
+		case isSqsEvent(event):
+			eventType = "sqs-event"
+		default:
+			eventType = "-"
 		}
-		ip := event["requestContext"].(map[string]any)["identity"].(map[string]any)["sourceIp"].(string)
-		method := event["httpMethod"]
-		lib.Logger.Println("http", r.StatusCode, method, path, authName, uid, time.Since(start), ip, timestamp())
-	} else {
-		uid, ok := event["Uid"].(string)
-		if !ok {
-			uid = "-"
-		}
-		authName, ok := event["AuthName"].(string)
-		if !ok {
-			authName = "-"
-		}
-		eventType, ok := event["EventType"].(string) // our event
-		if !ok {
-			_, ok = event["detail-type"].(string) // aws scheduled event
-			if ok {
-				eventType = "scheduled-event"
-			} else {
-				eventType = "-"
-			}
+	}
+	lib.Logger.Println("async-event", eventType, authName, uid, time.Since(start), id, timestamp())
+	return r.encode(formatRest)
+}
+
+// handle an api request of any event format, or from local mode
+func handleApiRequest(ctx context.Context, id string, req *Request) Response {
+	start := time.Now()
+	ctx = withRequestId(ctx, id)
+	res := make(chan Response)
+	go handle(ctx, nil, req, res)
+	r := <-res
+	if r.Headers == nil {
+		r.Headers = map[string]string{}
+	}
+	r.Headers[exec.HeaderRequestId] = id
+	uid := r.Headers["uid"]
+	if uid == "" {
+		uid = "-"
+	}
+	authName := r.Headers["auth-name"]
+	if authName == "" {
+		authName = "-"
+	}
+	ip := req.SourceIp
+	if ip == "" {
+		ip = "-"
+	}
+	lib.Logger.Println("http", r.StatusCode, req.Method, req.Path, authName, uid, time.Since(start), ip, id, timestamp())
+	return r
+}
+
+type requestIdKey struct{}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// the id of the request being handled, which correlates responses and
+// errors with service logs
+func RequestId(ctx context.Context) string {
+	id, ok := ctx.Value(requestIdKey{}).(string)
+	if !ok {
+		return "-"
+	}
+	return id
+}
+
+// use the api gateway request id when there is one
+func newRequestId(event map[string]any) string {
+	requestContext, ok := event["requestContext"].(map[string]any)
+	if ok {
+		id, ok := requestContext["requestId"].(string)
+		if ok && id != "" {
+			return id
 		}
-		lib.Logger.Println("async-event", eventType, authName, uid, time.Since(start), timestamp())
 	}
-	return r, nil
+	return uuid.Must(uuid.NewV4()).String()
 }
 
 func setupLogging(ctx context.Context) {
@@ -872,15 +1091,10 @@ func setupLogging(ctx context.Context) {
 			text := strings.Join(lines, "")
 			lines = nil
 			unix := time.Now().Unix()
-			key := fmt.Sprintf("logs/%d.%s.%03d", unix, uid, count)
+			key := store.ServiceLog(unix, uid, count)
 			count++
 			err := lib.Retry(context.Background(), func() error {
-				_, err := lib.S3Client().PutObject(context.Background(), &s3.PutObjectInput{
-					Bucket: aws.String(os.Getenv("PROJECT_BUCKET")),
-					Key:    aws.String(key),
-					Body:   bytes.NewReader([]byte(text)),
-				})
-				return err
+				return objects.Put(context.Background(), key, bytes.NewReader([]byte(text)))
 			})
 			if err != nil {
 				fmt.Println(err)
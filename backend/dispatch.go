@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sdkLambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	sdkLambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+// runs async events, ie jobs submitted via httpExecPost
+type Dispatcher interface {
+	Dispatch(ctx context.Context, event *exec.AsyncEvent) error
+}
+
+// a dispatcher that can run an event after a delay, which parks jobs
+// held by JOB_QUOTA_MODE=hold without a lambda waiting on them
+type DelayDispatcher interface {
+	Dispatcher
+	DispatchAfter(ctx context.Context, event *exec.AsyncEvent, delay time.Duration) error
+}
+
+// the dispatcher set by Serve() or tests, otherwise configured via env
+// as JOB_DISPATCH=lambda|sqs|goroutine, default lambda. sqs sends to
+// the queue named JOB_QUEUE, which must trigger this lambda.
+func jobDispatcher() Dispatcher {
+	if dispatcher != nil {
+		return dispatcher
+	}
+	switch os.Getenv("JOB_DISPATCH") {
+	case "", "lambda":
+		return lambdaDispatcher{}
+	case "sqs":
+		queue := os.Getenv("JOB_QUEUE")
+		if queue == "" {
+			panic("JOB_DISPATCH=sqs needs JOB_QUEUE")
+		}
+		return sqsDispatcher{queue: queue}
+	case "goroutine":
+		return goroutineDispatcher{}
+	default:
+		panic(fmt.Sprintf("bad job dispatch, expected lambda, sqs, or goroutine: %s", os.Getenv("JOB_DISPATCH")))
+	}
+}
+
+// invoke this lambda asynchronously
+type lambdaDispatcher struct{}
+
+func (lambdaDispatcher) Dispatch(ctx context.Context, event *exec.AsyncEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return lib.Retry(ctx, func() error {
+		out, err := lib.LambdaClient().Invoke(ctx, &sdkLambda.InvokeInput{
+			FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+			InvocationType: sdkLambdaTypes.InvocationTypeEvent,
+			LogType:        sdkLambdaTypes.LogTypeNone,
+			Payload:        data,
+		})
+		if err != nil {
+			return err
+		}
+		if out.StatusCode != 202 {
+			return fmt.Errorf("status %d", out.StatusCode)
+		}
+		return nil
+	})
+}
+
+// send to a queue which triggers this lambda, so jobs survive bursts
+// beyond the async invoke limits. see handleSqsEvent.
+type sqsDispatcher struct {
+	queue string
+}
+
+var sqsQueueUrls = &struct {
+	lock sync.Mutex
+	urls map[string]string
+}{
+	urls: map[string]string{},
+}
+
+func sqsQueueUrl(ctx context.Context, queue string) (string, error) {
+	sqsQueueUrls.lock.Lock()
+	defer sqsQueueUrls.lock.Unlock()
+	url, ok := sqsQueueUrls.urls[queue]
+	if ok {
+		return url, nil
+	}
+	url, err := lib.SQSQueueUrl(ctx, queue)
+	if err != nil {
+		return "", err
+	}
+	sqsQueueUrls.urls[queue] = url
+	return url, nil
+}
+
+func (d sqsDispatcher) Dispatch(ctx context.Context, event *exec.AsyncEvent) error {
+	return d.DispatchAfter(ctx, event, 0)
+}
+
+// delay is at most 15 minutes
+func (d sqsDispatcher) DispatchAfter(ctx context.Context, event *exec.AsyncEvent, delay time.Duration) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	url, err := sqsQueueUrl(ctx, d.queue)
+	if err != nil {
+		return err
+	}
+	return lib.Retry(ctx, func() error {
+		_, err := lib.SQSClient().SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:     aws.String(url),
+			MessageBody:  aws.String(string(data)),
+			DelaySeconds: int32(delay.Seconds()),
+		})
+		return err
+	})
+}
+
+// run the async events in the messages of an sqs trigger, one at a
+// time. failed jobs are not redelivered, since they already shipped
+// their exit code.
+func handleSqsEvent(ctx context.Context, event map[string]any, res chan<- Response) {
+	sqsEvent := events.SQSEvent{}
+	data, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(data, &sqsEvent)
+	if err != nil {
+		panic(err)
+	}
+	for _, record := range sqsEvent.Records {
+		asyncEvent := &exec.AsyncEvent{}
+		err := json.Unmarshal([]byte(record.Body), asyncEvent)
+		if err != nil || asyncEvent.EventType != exec.EventExec {
+			lib.Logger.Println("error: bad sqs message", record.MessageId, err)
+			continue
+		}
+		jobRes := make(chan Response)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logRecover(ctx, r, jobRes)
+				}
+			}()
+			handleAsyncEvent(ctx, asyncEvent, jobRes)
+		}()
+		r := <-jobRes
+		lib.Logger.Println("sqs-message", record.MessageId, r.StatusCode, asyncEvent.AuthName, asyncEvent.Uid)
+	}
+	res <- Response{
+		Body:       "ok",
+		StatusCode: 200,
+	}
+}
+
+// the event of an sqs trigger
+func isSqsEvent(event map[string]any) bool {
+	records, ok := event["Records"].([]any)
+	if !ok || len(records) == 0 {
+		return false
+	}
+	record, ok := records[0].(map[string]any)
+	return ok && record["eventSource"] == "aws:sqs"
+}
+
+// run in a goroutine of this process, ie in local mode or tests. not
+// for lambda, which freezes after responding.
+type goroutineDispatcher struct{}
+
+func (d goroutineDispatcher) Dispatch(ctx context.Context, event *exec.AsyncEvent) error {
+	return d.DispatchAfter(ctx, event, 0)
+}
+
+func (goroutineDispatcher) DispatchAfter(_ context.Context, event *exec.AsyncEvent, delay time.Duration) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	val := map[string]any{}
+	err = json.Unmarshal(data, &val)
+	if err != nil {
+		return err
+	}
+	time.AfterFunc(delay, func() {
+		handleEvent(context.Background(), val)
+	})
+	return nil
+}
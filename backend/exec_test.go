@@ -0,0 +1,271 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
+)
+
+type linesArgs struct {
+	Count int `json:"count"`
+	Width int `json:"width"`
+}
+
+func init() {
+	// print count lines of width bytes
+	exec.Rpc["test-lines"] = func(ctx context.Context, println func(v ...any), argsJson string) error {
+		args := linesArgs{}
+		err := json.Unmarshal([]byte(argsJson), &args)
+		if err != nil {
+			return err
+		}
+		for i := range args.Count {
+			line := fmt.Sprintf("line %d ", i)
+			println(line + strings.Repeat("x", max(0, args.Width-len(line))))
+		}
+		exec.Result(ctx, fmt.Sprint(args.Count))
+		return nil
+	}
+	exec.Rpc["test-error"] = func(_ context.Context, println func(v ...any), _ string) error {
+		println("before")
+		return errors.New("boom")
+	}
+	// fanout to a subprocess
+	exec.Rpc["test-fanout"] = func(ctx context.Context, _ func(v ...any), _ string) error {
+		_, err := exec.Fanout(ctx, []*exec.FanoutJob{{Argv: []string{"true"}}}, 1)
+		return err
+	}
+}
+
+func rpcArgs(t *testing.T, args any) string {
+	data, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// the log is shipped before exit and size, and size is written last
+func checkShipOrder(t *testing.T, keys []string, job store.JobLayout) {
+	t.Helper()
+	if len(keys) == 0 || keys[len(keys)-1] != job.Size() {
+		t.Fatalf("size not written last: %v", keys)
+	}
+	exit := slices.Index(keys, job.Exit())
+	if exit == -1 || slices.Index(keys[exit+1:], job.Exit()) != -1 {
+		t.Fatalf("exit not written once: %v", keys)
+	}
+	if slices.Index(keys[exit:], job.Log()) != -1 {
+		t.Fatalf("log written after exit: %v", keys)
+	}
+	if slices.Index(keys, job.Meta()) != 0 {
+		t.Fatalf("meta not written first: %v", keys)
+	}
+}
+
+func TestSubmitAndPoll(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"sh", "-c", "echo out; echo err >&2"},
+	})
+	// before the lambda runs, polls get a url for a log that does not exist
+	status, res := h.get(uid, 0)
+	if status != 200 || res.Exit != nil || res.Url == "" {
+		t.Fatalf("before run: %d %#v", status, res)
+	}
+	status, _ = rangeGet(t, res.Url, 0)
+	if status != 403 {
+		t.Fatalf("log before run: %d", status)
+	}
+	if h.lambda.run() != 1 {
+		t.Fatal("expected one async invoke")
+	}
+	log, exit := h.poll(uid)
+	if exit != 0 {
+		t.Fatalf("exit: %d", exit)
+	}
+	lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"err", "out"}) {
+		t.Fatalf("log: %q", log)
+	}
+	job := h.job(uid)
+	checkShipOrder(t, h.s3.putsWithPrefix(job.Prefix()), job)
+	if h.s3.get(t, job.Size()) != fmt.Sprint(len(log)) {
+		t.Fatalf("size: %s", h.s3.get(t, job.Size()))
+	}
+}
+
+func TestSubmitFailure(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"sh", "-c", "echo fail; exit 3"},
+	})
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if log != "fail\n" || exit != 1 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+}
+
+// cmd.Start() fails, and only the error is logged
+func TestSubmitMissingCommand(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"/does/not/exist"},
+	})
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if !strings.HasPrefix(log, "error: ") || exit != 1 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+	job := h.job(uid)
+	checkShipOrder(t, h.s3.putsWithPrefix(job.Prefix()), job)
+}
+
+func TestSubmitRpc(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		RpcName: "test-lines",
+		RpcArgs: rpcArgs(t, linesArgs{Count: 3}),
+	})
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if log != "line 0 \nline 1 \nline 2 \n" || exit != 0 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+	status, body := h.api(http.MethodGet, "/api/jobs/"+uid, nil, nil)
+	meta := exec.JobMeta{}
+	err := json.Unmarshal(body, &meta)
+	if status != 200 || err != nil || meta.Result != "3" || meta.RpcName != "test-lines" {
+		t.Fatalf("job: %d %s", status, body)
+	}
+}
+
+func TestSubmitRpcError(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		RpcName: "test-error",
+	})
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if log != "before\nerror: boom\n" || exit != 1 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+}
+
+// fanout children are held to the scopes of the parent
+func TestFanoutScopes(t *testing.T) {
+	h := newHarness(t)
+	key := exec.RandKey()
+	record, err := auths.Create(context.Background(), key, exec.RecordData{
+		Value:  "test",
+		Scopes: []string{exec.ScopeRpcPrefix + "test-fanout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.auth, h.authName = key, record.AuthName()
+	uid := h.submit(&exec.PostRequest{
+		RpcName: "test-fanout",
+	})
+	if h.lambda.run() != 1 {
+		t.Fatal("expected only the parent job")
+	}
+	log, exit := h.poll(uid)
+	if log != "error: fanout job missing scope: exec:argv\n" || exit != 1 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	h := newHarness(t)
+	status, _ := h.api(http.MethodPost, "/api/exec", nil, &exec.PostRequest{RpcName: "missing"})
+	if status != 404 {
+		t.Fatalf("missing rpc: %d", status)
+	}
+	h.auth = exec.RandKey()
+	status, _ = h.api(http.MethodPost, "/api/exec", nil, &exec.PostRequest{Argv: []string{"true"}})
+	if status != 401 {
+		t.Fatalf("bad auth: %d", status)
+	}
+	if h.lambda.run() != 0 {
+		t.Fatal("expected no async invokes")
+	}
+}
+
+func TestPollPastSize(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"echo", "hi"},
+	})
+	h.lambda.run()
+	status, _ := h.get(uid, 4)
+	if status != 400 {
+		t.Fatalf("range-start past size: %d", status)
+	}
+	status, res := h.get(uid, 3)
+	if status != 200 || res.Exit == nil || *res.Exit != 0 {
+		t.Fatalf("range-start at size: %d %#v", status, res)
+	}
+}
+
+func TestPushUrls(t *testing.T) {
+	h := newHarness(t)
+	push := newFakePush(t)
+	uid := h.submit(&exec.PostRequest{
+		PushUrls: push.urls(),
+		RpcName:  "test-lines",
+		RpcArgs:  rpcArgs(t, linesArgs{Count: 2}),
+	})
+	h.lambda.run()
+	log := push.bodies["/log"]
+	if log != "line 0 \nline 1 \n" {
+		t.Fatalf("log: %q", log)
+	}
+	if push.bodies["/exit"] != "0" || push.bodies["/size"] != fmt.Sprint(len(log)) {
+		t.Fatalf("exit: %q size: %q", push.bodies["/exit"], push.bodies["/size"])
+	}
+	if !slices.Equal(push.puts[len(push.puts)-2:], []string{"/exit", "/size"}) || slices.Index(push.puts, "/exit") != len(push.puts)-2 {
+		t.Fatalf("puts: %v", push.puts)
+	}
+	// nothing is written to the internal bucket, not even metadata
+	keys := h.s3.putsWithPrefix(h.job(uid).Prefix())
+	if len(keys) != 0 {
+		t.Fatalf("internal puts: %v", keys)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	h := newHarness(t)
+	width := 1000
+	uid := h.submit(&exec.PostRequest{
+		RpcName: "test-lines",
+		RpcArgs: rpcArgs(t, linesArgs{Count: exec.MaxLogBytes/width + 100, Width: width}),
+	})
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if exit != 0 {
+		t.Fatalf("exit: %d", exit)
+	}
+	body, ok := strings.CutSuffix(log, "[log truncated]\n")
+	if !ok {
+		t.Fatalf("log not truncated: %q", log[max(0, len(log)-100):])
+	}
+	// lines are kept until the limit is reached, and never split
+	if len(body) < exec.MaxLogBytes || len(body) >= exec.MaxLogBytes+width+1 || !strings.HasSuffix(body, "x\n") {
+		t.Fatalf("truncated at: %d", len(body))
+	}
+	job := h.job(uid)
+	if h.s3.get(t, job.Size()) != fmt.Sprint(len(log)) {
+		t.Fatalf("size: %s, log: %d", h.s3.get(t, job.Size()), len(log))
+	}
+}
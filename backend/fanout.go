@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
+)
+
+// launch child jobs on behalf of a parent rpc via the same async
+// invoke as httpExecPost, then follow them in the internal store.
+// children need the same scopes httpExecPost would check, and inherit
+// the scopes of their parent.
+func fanout(parent *exec.AsyncEvent, println func(v ...any)) func(ctx context.Context, jobs []*exec.FanoutJob, concurrency int) ([]*exec.FanoutResult, error) {
+	return func(ctx context.Context, jobs []*exec.FanoutJob, concurrency int) ([]*exec.FanoutResult, error) {
+		for _, job := range jobs {
+			_, ok := exec.Rpc[job.RpcName]
+			if !ok && job.RpcName != "" {
+				return nil, fmt.Errorf("no such rpc: %s", job.RpcName)
+			}
+			if job.RpcName == "" && len(job.Argv) == 0 {
+				return nil, fmt.Errorf("fanout job needs argv or rpc name")
+			}
+			scope := exec.ScopeExecArgv
+			if job.RpcName != "" {
+				scope = exec.ScopeRpcPrefix + job.RpcName
+			}
+			if !exec.HasScope(parent.Scopes, scope) {
+				return nil, fmt.Errorf("fanout job missing scope: %s", scope)
+			}
+		}
+		results := make([]*exec.FanoutResult, len(jobs))
+		errs := make([]error, len(jobs))
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for i, job := range jobs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				defer func() {
+					if r := recover(); r != nil {
+						errs[i] = fmt.Errorf("fanout job %d: %v", i, r)
+					}
+				}()
+				uid := newUid()
+				child := &exec.AsyncEvent{
+					EventType: exec.EventExec,
+					Uid:       uid,
+					ParentUid: parent.Uid,
+					AuthName:  parent.AuthName,
+					Scopes:    parent.Scopes,
+					Argv:      job.Argv,
+					RpcName:   job.RpcName,
+					RpcArgs:   job.RpcArgs,
+				}
+				invokeAsync(ctx, child)
+				auditJobSubmit(ctx, "", child)
+				prefixer := &exec.LinePrefixer{
+					Prefix: fmt.Sprintf("[%d] ", i),
+					Println: func(line string) {
+						println(line)
+					},
+				}
+				job := store.Job(parent.AuthName, uid)
+				exit, err := exec.Tail(ctx, &exec.TailArgs{
+					Store: objects,
+					PullKeys: &exec.PullKeys{
+						Log:  job.Log(),
+						Size: job.Size(),
+						Exit: job.Exit(),
+					},
+					LogShipInterval: exec.LogShipInterval,
+					LogDataCallback: prefixer.Write,
+				})
+				prefixer.Flush()
+				if err != nil {
+					errs[i] = fmt.Errorf("fanout job %d: %w", i, err)
+					return
+				}
+				result := &exec.FanoutResult{
+					Uid:  uid,
+					Exit: exit,
+				}
+				meta := getMeta(ctx, job.Meta())
+				if meta != nil {
+					result.Result = meta.Result
+				}
+				results[i] = result
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return results, err
+			}
+		}
+		return results, nil
+	}
+}
@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// records as json in a single file, for local mode. every write
+// rewrites the file via rename. serve and the auth cli commands can
+// write at once, so writes hold a flock on a lock file next to it, and
+// the mutex covers goroutines of this process.
+type fileTable struct {
+	lock sync.Mutex
+	path string
+}
+
+func newFileTable(path string) *fileTable {
+	return &fileTable{path: path}
+}
+
+// expired records are deleted by sweepExpired
+func (t *fileTable) ttl() bool {
+	return false
+}
+
+func (t *fileTable) load() (map[string]json.RawMessage, error) {
+	records := map[string]json.RawMessage{}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (t *fileTable) save(records map[string]json.RawMessage) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// hold the lock file until unlock is called
+func (t *fileTable) flock() (func(), error) {
+	f, err := os.OpenFile(t.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// load, apply fn, and save if fn changed the records
+func (t *fileTable) update(fn func(records map[string]json.RawMessage) (bool, error)) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	unlock, err := t.flock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	records, err := t.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(records)
+	if err != nil || !changed {
+		return err
+	}
+	return t.save(records)
+}
+
+func marshalRecord(record any) (string, json.RawMessage, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", nil, err
+	}
+	key := exec.RecordKey{}
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return "", nil, err
+	}
+	if key.ID == "" {
+		return "", nil, errors.New("record without id")
+	}
+	return key.ID, data, nil
+}
+
+func (t *fileTable) get(_ context.Context, id string, out any) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	records, err := t.load()
+	if err != nil {
+		return false, err
+	}
+	data, ok := records[id]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, out)
+}
+
+func (t *fileTable) put(_ context.Context, record any) error {
+	id, data, err := marshalRecord(record)
+	if err != nil {
+		return err
+	}
+	return t.update(func(records map[string]json.RawMessage) (bool, error) {
+		records[id] = data
+		return true, nil
+	})
+}
+
+func (t *fileTable) putIfNotExists(_ context.Context, record any) (bool, error) {
+	id, data, err := marshalRecord(record)
+	if err != nil {
+		return false, err
+	}
+	put := false
+	err = t.update(func(records map[string]json.RawMessage) (bool, error) {
+		_, exists := records[id]
+		if !exists {
+			records[id] = data
+			put = true
+		}
+		return put, nil
+	})
+	return put, err
+}
+
+func (t *fileTable) putIfVersion(_ context.Context, record tableRecord, version int64) (bool, error) {
+	record.Version = version + 1
+	id, data, err := marshalRecord(record)
+	if err != nil {
+		return false, err
+	}
+	put := false
+	err = t.update(func(records map[string]json.RawMessage) (bool, error) {
+		stored := tableRecord{}
+		old, exists := records[id]
+		if exists {
+			err := json.Unmarshal(old, &stored)
+			if err != nil {
+				return false, err
+			}
+		}
+		if exists != (version != 0) || stored.Version != version {
+			return false, nil
+		}
+		records[id] = data
+		put = true
+		return true, nil
+	})
+	return put, err
+}
+
+func (t *fileTable) delete(_ context.Context, id string) error {
+	return t.update(func(records map[string]json.RawMessage) (bool, error) {
+		_, exists := records[id]
+		delete(records, id)
+		return exists, nil
+	})
+}
+
+func (t *fileTable) deleteIfVersion(_ context.Context, id string, version int64) (bool, error) {
+	deleted := false
+	err := t.update(func(records map[string]json.RawMessage) (bool, error) {
+		data, exists := records[id]
+		if !exists {
+			return false, nil
+		}
+		stored := tableRecord{}
+		err := json.Unmarshal(data, &stored)
+		if err != nil {
+			return false, err
+		}
+		if stored.Version != version {
+			return false, nil
+		}
+		delete(records, id)
+		deleted = true
+		return true, nil
+	})
+	return deleted, err
+}
+
+func (t *fileTable) touch(_ context.Context, id, ip string, now, threshold int64) error {
+	return t.update(func(records map[string]json.RawMessage) (bool, error) {
+		data, exists := records[id]
+		if !exists {
+			return false, nil
+		}
+		record := tableRecord{}
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return false, err
+		}
+		if record.LastUsedAt >= threshold {
+			return false, nil
+		}
+		record.LastUsedAt = now
+		record.LastIp = ip
+		_, records[id], err = marshalRecord(record)
+		return err == nil, err
+	})
+}
+
+func (t *fileTable) bumpVersion(_ context.Context, id string) error {
+	return t.update(func(records map[string]json.RawMessage) (bool, error) {
+		record := tableRecord{Record: exec.Record{RecordKey: exec.RecordKey{ID: id}}}
+		data, exists := records[id]
+		if exists {
+			err := json.Unmarshal(data, &record)
+			if err != nil {
+				return false, err
+			}
+		}
+		record.Version++
+		var err error
+		_, records[id], err = marshalRecord(record)
+		return err == nil, err
+	})
+}
+
+// fn is called without the lock held, so it can write records
+func (t *fileTable) scan(_ context.Context, prefix string, fn func(decode func(out any) error) error) error {
+	t.lock.Lock()
+	records, err := t.load()
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for id := range records {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		err := fn(func(out any) error {
+			return json.Unmarshal(records[id], out)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// serve and the auth cli commands each open the records file, so no
+// write may be lost when both write at once
+func TestFileTableConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	tables := []*fileTable{newFileTable(path), newFileTable(path)}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i, table := range tables {
+		for j := range 200 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := table.putIfNotExists(ctx, exec.Record{
+					RecordKey: exec.RecordKey{
+						ID: fmt.Sprintf("test.%d.%d", i, j),
+					},
+				})
+				if err != nil || !ok {
+					t.Error(ok, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	count := 0
+	err := newFileTable(path).scan(ctx, "test.", func(_ func(out any) error) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 400 {
+		t.Fatalf("expected 400 records, got %d", count)
+	}
+}
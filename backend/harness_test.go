@@ -0,0 +1,333 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
+)
+
+// in-process fakes for s3, dynamodb and lambda, wired into the package
+// level dependencies of the backend. tests drive HandleRequest with
+// synthetic events, so they cannot run in parallel.
+type harness struct {
+	t        *testing.T
+	s3       *fakeS3
+	lambda   *fakeLambda
+	auth     string
+	authName string
+}
+
+func newHarness(t *testing.T) *harness {
+	dir := t.TempDir()
+	prevObjects, prevTable, prevAuths, prevDispatcher := objects, table, auths, dispatcher
+	t.Cleanup(func() {
+		objects, table, auths, dispatcher = prevObjects, prevTable, prevAuths, prevDispatcher
+	})
+	s3 := newFakeS3(t, filepath.Join(dir, "objects"))
+	lambda := &fakeLambda{t: t}
+	objects = s3
+	table = newFileTable(localRecords(dir)) // dynamodb
+	auths = tableAuthStore{table: table}
+	dispatcher = lambda
+	auditAuthOkThrottle = newAuditThrottle(authUsageInterval)
+	auditAuthFailThrottle = newAuditThrottle(authFailInterval)
+	key := exec.RandKey()
+	record, err := auths.Create(context.Background(), key, exec.RecordData{
+		Value: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &harness{
+		t:        t,
+		s3:       s3,
+		lambda:   lambda,
+		auth:     key,
+		authName: record.AuthName(),
+	}
+}
+
+func (h *harness) job(uid string) store.JobLayout {
+	return store.Job(h.authName, uid)
+}
+
+// invoke like the lambda runtime, with a fresh context per invocation
+func invoke(t *testing.T, event map[string]any) any {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := HandleRequest(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// send an api gateway rest event with header auth, returning the status
+// and body
+func (h *harness) api(method, path string, query map[string]string, body any) (int, []byte) {
+	h.t.Helper()
+	return h.request(method, path, query, map[string]string{"auth": h.auth}, body)
+}
+
+// send an api gateway rest event with headers, returning the status and
+// body
+func (h *harness) request(method, path string, query, headers map[string]string, body any) (int, []byte) {
+	h.t.Helper()
+	data := []byte{}
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	res, ok := invoke(h.t, map[string]any{
+		"httpMethod":            method,
+		"path":                  path,
+		"headers":               headers,
+		"queryStringParameters": query,
+		"body":                  string(data),
+		"requestContext": map[string]any{
+			"identity": map[string]any{
+				"sourceIp": "127.0.0.1",
+			},
+		},
+	}).(events.APIGatewayProxyResponse)
+	if !ok {
+		h.t.Fatal("expected a rest api response")
+	}
+	return res.StatusCode, []byte(res.Body)
+}
+
+// POST /api/exec, returning the uid
+func (h *harness) submit(req *exec.PostRequest) string {
+	h.t.Helper()
+	status, body := h.api(http.MethodPost, "/api/exec", nil, req)
+	if status != 200 {
+		h.t.Fatalf("submit: %d %s", status, body)
+	}
+	res := exec.PostResponse{}
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return res.Uid
+}
+
+// GET /api/exec at range-start
+func (h *harness) get(uid string, rangeStart int) (int, *exec.GetResponse) {
+	h.t.Helper()
+	status, body := h.api(http.MethodGet, "/api/exec", map[string]string{
+		"uid":         uid,
+		"range-start": fmt.Sprint(rangeStart),
+	}, nil)
+	res := &exec.GetResponse{}
+	if status == 200 {
+		err := json.Unmarshal(body, res)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	return status, res
+}
+
+// follow a finished job like exec.Exec(), returning its log and exit
+func (h *harness) poll(uid string) (string, int) {
+	h.t.Helper()
+	var log []byte
+	for range 100 {
+		status, res := h.get(uid, len(log))
+		if status != 200 {
+			h.t.Fatalf("poll: %d", status)
+		}
+		if res.Exit != nil {
+			return string(log), *res.Exit
+		}
+		status, data := rangeGet(h.t, res.Url, len(log))
+		if status != 200 && status != 206 {
+			h.t.Fatalf("poll: log at range-start %d: %d", len(log), status)
+		}
+		log = append(log, data...)
+	}
+	h.t.Fatal("poll: no exit")
+	return "", 0
+}
+
+func rangeGet(t *testing.T, url string, start int) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("range", fmt.Sprintf("bytes=%d-", start))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+// s3 as a store.Dir served over http, so presigned urls work. puts are
+// recorded in order.
+type fakeS3 struct {
+	*store.Dir
+	lock sync.Mutex
+	puts []string
+}
+
+func newFakeS3(t *testing.T, root string) *fakeS3 {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	s3 := &fakeS3{Dir: store.NewDir(root, server.URL)}
+	mux.Handle("/_store/", s3.Dir)
+	return s3
+}
+
+func (s *fakeS3) Put(ctx context.Context, key string, body io.Reader) error {
+	s.lock.Lock()
+	s.puts = append(s.puts, key)
+	s.lock.Unlock()
+	return s.Dir.Put(ctx, key, body)
+}
+
+// the puts of keys with prefix, in order
+func (s *fakeS3) putsWithPrefix(prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []string
+	for _, key := range s.puts {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *fakeS3) get(t *testing.T, key string) string {
+	t.Helper()
+	data, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// async lambda invokes are queued, and run when the test calls run().
+// delayed dispatches are parked until the test calls unpark().
+type fakeLambda struct {
+	t      *testing.T
+	lock   sync.Mutex
+	queued []map[string]any
+	parked []map[string]any
+}
+
+func (l *fakeLambda) Dispatch(ctx context.Context, event *exec.AsyncEvent) error {
+	return l.DispatchAfter(ctx, event, 0)
+}
+
+func (l *fakeLambda) DispatchAfter(_ context.Context, event *exec.AsyncEvent, delay time.Duration) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload := map[string]any{}
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if delay > 0 {
+		l.parked = append(l.parked, payload)
+	} else {
+		l.queued = append(l.queued, payload)
+	}
+	return nil
+}
+
+// queue the parked events, returning how many there were
+func (l *fakeLambda) unpark() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := len(l.parked)
+	l.queued = append(l.queued, l.parked...)
+	l.parked = nil
+	return count
+}
+
+// invoke every queued event, including any queued while running,
+// failing the test unless each one succeeds
+func (l *fakeLambda) run() int {
+	l.t.Helper()
+	count := 0
+	for {
+		l.lock.Lock()
+		if len(l.queued) == 0 {
+			l.lock.Unlock()
+			return count
+		}
+		payload := l.queued[0]
+		l.queued = l.queued[1:]
+		l.lock.Unlock()
+		res, ok := invoke(l.t, payload).(events.APIGatewayProxyResponse)
+		if !ok || res.StatusCode != 200 {
+			l.t.Fatalf("async invoke: %#v", res)
+		}
+		count++
+	}
+}
+
+// presigned put urls, recording each put in order
+type fakePush struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	puts   []string
+	bodies map[string]string
+}
+
+func newFakePush(t *testing.T) *fakePush {
+	p := &fakePush{bodies: map[string]string{}}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.puts = append(p.puts, r.URL.Path)
+		p.bodies[r.URL.Path] = string(data)
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakePush) urls() *exec.PushUrls {
+	return &exec.PushUrls{
+		Log:  p.server.URL + "/log",
+		Exit: p.server.URL + "/exit",
+		Size: p.server.URL + "/size",
+	}
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// an error returned to the caller as a json exec.ErrorResponse
+type HttpError struct {
+	Status  int
+	Code    string // one of exec.ErrorCode*
+	Message string
+	Headers map[string]string // ie Retry-After
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func BadRequest(format string, v ...any) *HttpError {
+	return &HttpError{Status: http.StatusBadRequest, Code: exec.ErrorCodeBadRequest, Message: fmt.Sprintf(format, v...)}
+}
+
+func Forbidden(format string, v ...any) *HttpError {
+	return &HttpError{Status: http.StatusForbidden, Code: exec.ErrorCodeForbidden, Message: fmt.Sprintf(format, v...)}
+}
+
+func NotFound(format string, v ...any) *HttpError {
+	return &HttpError{Status: http.StatusNotFound, Code: exec.ErrorCodeNotFound, Message: fmt.Sprintf(format, v...)}
+}
+
+func Conflict(format string, v ...any) *HttpError {
+	return &HttpError{Status: http.StatusConflict, Code: exec.ErrorCodeConflict, Message: fmt.Sprintf(format, v...)}
+}
+
+// clients wait for Retry-After and try again
+func RateLimited(retryAfter time.Duration) *HttpError {
+	seconds := max(1, int(retryAfter.Seconds()+0.999))
+	return &HttpError{
+		Status:  http.StatusTooManyRequests,
+		Code:    exec.ErrorCodeRateLimited,
+		Message: fmt.Sprintf("rate limited, retry after %ds", seconds),
+		Headers: map[string]string{
+			"Retry-After": fmt.Sprint(seconds),
+		},
+	}
+}
+
+// like RateLimited(), but without Retry-After since clients should not wait
+func QuotaExceeded(format string, v ...any) *HttpError {
+	return &HttpError{Status: http.StatusTooManyRequests, Code: exec.ErrorCodeQuotaExceeded, Message: fmt.Sprintf(format, v...)}
+}
+
+func errorResponse(err *HttpError) Response {
+	data, marshalErr := json.Marshal(exec.ErrorResponse{
+		Error:   err.Code,
+		Message: err.Message,
+	})
+	if marshalErr != nil {
+		panic(marshalErr)
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	for k, v := range err.Headers {
+		headers[k] = v
+	}
+	return Response{
+		StatusCode: err.Status,
+		Body:       string(data),
+		Headers:    headers,
+	}
+}
+
+// implemented by request types that check themselves after decoding.
+// errors that are not a *HttpError become 400.
+type Validator interface {
+	Validate() error
+}
+
+type headersKey struct{}
+
+type eventKey struct{}
+
+// the source ip of the request being handled by a JSON() handler
+func sourceIp(ctx context.Context) string {
+	event, ok := ctx.Value(eventKey{}).(*Request)
+	if !ok {
+		return ""
+	}
+	return event.SourceIp
+}
+
+type responseHeaders struct {
+	lock    sync.Mutex
+	headers map[string]string
+}
+
+// set a header on the response of a JSON() handler
+func SetHeader(ctx context.Context, key, val string) {
+	h, ok := ctx.Value(headersKey{}).(*responseHeaders)
+	if !ok {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.headers[key] = val
+}
+
+// adapt a typed function into a route handler. the request is decoded
+// from the json body, then query and path parameters by json tag, then
+// validated. a *HttpError from fn is returned to the caller, any other
+// error is a 500.
+func JSON[Req, Resp any](fn func(ctx context.Context, auth *Auth, req *Req) (*Resp, error)) RouteHandler {
+	return func(ctx context.Context, event *Request, res chan<- Response, auth *Auth) {
+		req := new(Req)
+		err := decodeRequest(event, req)
+		if err != nil {
+			res <- errorResponse(BadRequest("%s", err))
+			return
+		}
+		validator, ok := any(req).(Validator)
+		if ok {
+			err = validator.Validate()
+			if err != nil {
+				res <- errorResponse(asHttpError(err, BadRequest("%s", err)))
+				return
+			}
+		}
+		h := &responseHeaders{
+			headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+		}
+		if auth != nil {
+			h.headers["auth-name"] = auth.Name
+		}
+		ctx = context.WithValue(ctx, headersKey{}, h)
+		ctx = context.WithValue(ctx, eventKey{}, event)
+		resp, err := fn(ctx, auth, req)
+		if err != nil {
+			var httpErr *HttpError
+			if errors.As(err, &httpErr) {
+				res <- errorResponse(httpErr)
+				return
+			}
+			panic(err)
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			panic(err)
+		}
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		res <- Response{
+			StatusCode: 200,
+			Body:       string(data),
+			Headers:    h.headers,
+		}
+	}
+}
+
+func asHttpError(err error, otherwise *HttpError) *HttpError {
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	return otherwise
+}
+
+func decodeRequest(event *Request, req any) error {
+	body := event.Body
+	if event.IsBase64Encoded {
+		data, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return fmt.Errorf("bad body: %w", err)
+		}
+		body = string(data)
+	}
+	if strings.TrimSpace(body) != "" {
+		err := json.Unmarshal([]byte(body), req)
+		if err != nil {
+			return fmt.Errorf("bad body: %w", err)
+		}
+	}
+	err := decodeParams(event.Query, req)
+	if err != nil {
+		return err
+	}
+	return decodeParams(event.PathParameters, req)
+}
+
+// set struct fields from string parameters by json tag
+func decodeParams(params map[string]string, req any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	val := reflect.ValueOf(req).Elem()
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+	typ := val.Type()
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		param, ok := params[name]
+		if !ok {
+			continue
+		}
+		f := val.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(param)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s, expected integer: %s", name, param)
+			}
+			f.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(param, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s, expected positive integer: %s", name, param)
+			}
+			f.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s, expected number: %s", name, param)
+			}
+			f.SetFloat(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(param)
+			if err != nil {
+				return fmt.Errorf("bad %s, expected boolean: %s", name, param)
+			}
+			f.SetBool(b)
+		default:
+			return fmt.Errorf("%s cannot be a parameter", name)
+		}
+	}
+	return nil
+}
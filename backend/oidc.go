@@ -0,0 +1,301 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// jwt bearer tokens from an oidc identity provider are accepted when
+// OIDC_ISSUER is set. tokens are validated against OIDC_ISSUER,
+// OIDC_AUDIENCE, and the keys in OIDC_JWKS, a file path or url. the
+// OIDC_NAME_CLAIM, default email, becomes the auth name. scopes come
+// from OIDC_SCOPES_CLAIM, default scope, and only scopes known to
+// aws-exec are kept.
+const (
+	oidcLeeway          = 60 * time.Second
+	oidcJwksMinInterval = 60 * time.Second
+)
+
+var errTokenInvalid = errors.New("invalid token")
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var oidcJwks = &struct {
+	lock     sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadTime time.Time
+}{}
+
+func oidcEnabled() bool {
+	return os.Getenv("OIDC_ISSUER") != ""
+}
+
+// tokens are never checked against an empty audience, so OIDC_ISSUER
+// without OIDC_AUDIENCE is a config error
+func oidcAudience() string {
+	audience := os.Getenv("OIDC_AUDIENCE")
+	if audience == "" {
+		panic("OIDC_AUDIENCE is required when OIDC_ISSUER is set")
+	}
+	return audience
+}
+
+func bearerToken(headers map[string]string) (string, bool) {
+	header, ok := exec.CaseInsensitiveGet(headers, "authorization")
+	if !ok {
+		return "", false
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return token, ok && token != ""
+}
+
+// authenticate via jwt, mapping claims to auth name and scopes
+func checkBearer(ctx context.Context, token string) (*Auth, error) {
+	audience := oidcAudience()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenInvalid
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	key, ok := oidcKey(ctx, header.Kid)
+	if !ok {
+		return nil, errTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errTokenInvalid
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errTokenInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errTokenInvalid
+		}
+	default:
+		return nil, errTokenInvalid
+	}
+	claims := map[string]any{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	now := time.Now()
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	if iss != os.Getenv("OIDC_ISSUER") || sub == "" {
+		return nil, errTokenInvalid
+	}
+	if !audienceMatches(claims["aud"], audience) {
+		return nil, errTokenInvalid
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errAuthExpired
+	}
+	nbf, ok := claims["nbf"].(float64)
+	if ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errTokenInvalid
+	}
+	nameClaim := os.Getenv("OIDC_NAME_CLAIM")
+	if nameClaim == "" {
+		nameClaim = "email"
+	}
+	name, _ := claims[nameClaim].(string)
+	if name == "" {
+		return nil, errTokenInvalid
+	}
+	scopesClaim := os.Getenv("OIDC_SCOPES_CLAIM")
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+	}
+	return &Auth{
+		Name:    name + ":" + exec.Blake2b32(iss + "\n" + sub)[:16],
+		Scopes:  claimScopes(claims[scopesClaim]),
+		Expires: int64(exp),
+	}, nil
+}
+
+func decodeSegment(segment string, out any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func audienceMatches(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, x := range aud {
+			if x == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keep scopes known to aws-exec. since no scopes is all-powerful,
+// a token without any known scopes gets a scope that grants nothing.
+func claimScopes(claim any) []string {
+	var xs []string
+	switch claim := claim.(type) {
+	case string:
+		xs = strings.Fields(claim)
+	case []any:
+		for _, x := range claim {
+			s, ok := x.(string)
+			if ok {
+				xs = append(xs, s)
+			}
+		}
+	}
+	var scopes []string
+	for _, scope := range xs {
+		if exec.ValidScope(scope) == nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{exec.ScopeNone}
+	}
+	return scopes
+}
+
+// get a key by id, reloading the jwks when the id is unknown. the fetch
+// runs without the lock, so a slow identity provider only blocks tokens
+// with unknown key ids.
+func oidcKey(ctx context.Context, kid string) (crypto.PublicKey, bool) {
+	oidcJwks.lock.Lock()
+	key, ok := oidcJwks.keys[kid]
+	if ok || time.Since(oidcJwks.loadTime) < oidcJwksMinInterval {
+		oidcJwks.lock.Unlock()
+		return key, ok
+	}
+	oidcJwks.loadTime = time.Now()
+	oidcJwks.lock.Unlock()
+	keys, err := loadJwks(ctx, os.Getenv("OIDC_JWKS"))
+	if err != nil {
+		panic(err)
+	}
+	oidcJwks.lock.Lock()
+	oidcJwks.keys = keys
+	oidcJwks.lock.Unlock()
+	key, ok = keys[kid]
+	return key, ok
+}
+
+func loadJwks(ctx context.Context, source string) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("jwks %s: http %d", source, resp.StatusCode)
+		}
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
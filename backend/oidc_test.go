@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "aws-exec"
+)
+
+// serve a jwks with one rs256 key from a file, returning the key
+func setupOidc(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]any{
+		"keys": []jwk{{
+			Kid: "test",
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OIDC_ISSUER", testIssuer)
+	t.Setenv("OIDC_AUDIENCE", testAudience)
+	t.Setenv("OIDC_JWKS", path)
+	resetJwks := func() {
+		oidcJwks.lock.Lock()
+		oidcJwks.keys = nil
+		oidcJwks.loadTime = time.Time{}
+		oidcJwks.lock.Unlock()
+	}
+	resetJwks()
+	t.Cleanup(resetJwks)
+	return key
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestCheckBearer(t *testing.T) {
+	key := setupOidc(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(update func(claims map[string]any)) map[string]any {
+		claims := map[string]any{
+			"iss":   testIssuer,
+			"aud":   testAudience,
+			"sub":   "user-1",
+			"email": "user@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "jobs:read",
+		}
+		if update != nil {
+			update(claims)
+		}
+		return claims
+	}
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", signToken(t, key, "test", claims(nil)), nil},
+		{"audience list", signToken(t, key, "test", claims(func(c map[string]any) { c["aud"] = []string{"other", testAudience} })), nil},
+		{"bad signature", signToken(t, otherKey, "test", claims(nil)), errTokenInvalid},
+		{"unknown kid", signToken(t, key, "other", claims(nil)), errTokenInvalid},
+		{"expired", signToken(t, key, "test", claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), errAuthExpired},
+		{"missing exp", signToken(t, key, "test", claims(func(c map[string]any) { delete(c, "exp") })), errAuthExpired},
+		{"wrong issuer", signToken(t, key, "test", claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), errTokenInvalid},
+		{"wrong audience", signToken(t, key, "test", claims(func(c map[string]any) { c["aud"] = "other" })), errTokenInvalid},
+		{"empty audience", signToken(t, key, "test", claims(func(c map[string]any) { c["aud"] = "" })), errTokenInvalid},
+		{"not yet valid", signToken(t, key, "test", claims(func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), errTokenInvalid},
+		{"malformed", "not.a-token", errTokenInvalid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			auth, err := checkBearer(context.Background(), c.token)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if err == nil && (auth.Name == "" || len(auth.Scopes) != 1 || auth.Scopes[0] != "jobs:read") {
+				t.Fatalf("auth: %#v", auth)
+			}
+		})
+	}
+}
+
+func TestCheckBearerRequiresAudience(t *testing.T) {
+	key := setupOidc(t)
+	t.Setenv("OIDC_AUDIENCE", "")
+	token := signToken(t, key, "test", map[string]any{
+		"iss": testIssuer,
+		"aud": "",
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a config error")
+		}
+	}()
+	_, _ = checkBearer(context.Background(), token)
+}
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
+	"github.com/nathants/libaws/lib"
+)
+
+// per-auth limit on concurrently running jobs, configured via env as
+// JOB_QUOTA=<count>. each running job holds a lease in the quota
+// record for its auth. submissions over the quota are rejected, or
+// with JOB_QUOTA_MODE=hold, are parked on a delayed dispatch until a
+// lease frees up or until JOB_QUOTA_HOLD, default 1h, passes. hold
+// needs a DelayDispatcher, ie JOB_DISPATCH=sqs. jobs launched via
+// Fanout() run under the lease of their parent.
+const (
+	leaseTtl          = 16 * time.Minute // jobs run at most 14 minutes
+	quotaHoldInterval = 15 * time.Second
+	quotaHoldDefault  = 1 * time.Hour
+	quotaAttempts     = 10
+)
+
+func jobQuota() int {
+	val := os.Getenv("JOB_QUOTA")
+	if val == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("bad job quota: %s", val))
+	}
+	return n
+}
+
+func jobQuotaHold() bool {
+	switch os.Getenv("JOB_QUOTA_MODE") {
+	case "", "reject":
+		return false
+	case "hold":
+		_, ok := jobDispatcher().(DelayDispatcher)
+		if !ok {
+			panic("JOB_QUOTA_MODE=hold needs JOB_DISPATCH=sqs or goroutine")
+		}
+		return true
+	default:
+		panic(fmt.Sprintf("bad job quota mode, expected reject or hold: %s", os.Getenv("JOB_QUOTA_MODE")))
+	}
+}
+
+func jobQuotaHoldMax() time.Duration {
+	val := os.Getenv("JOB_QUOTA_HOLD")
+	if val == "" {
+		return quotaHoldDefault
+	}
+	duration, err := exec.ParseDuration(val)
+	if err != nil {
+		panic(fmt.Sprintf("bad job quota hold: %s", val))
+	}
+	return duration
+}
+
+// park a job over quota, dispatching it again after an interval,
+// returning false once it has been held for too long
+func holdJob(ctx context.Context, event *exec.AsyncEvent) bool {
+	if event.HeldSince == 0 {
+		event.HeldSince = time.Now().Unix()
+	}
+	if time.Since(time.Unix(event.HeldSince, 0)) > jobQuotaHoldMax() {
+		return false
+	}
+	if event.PushUrls == nil {
+		// lets clients polling the job know it is not lost
+		putMeta(ctx, store.Job(event.AuthName, event.Uid).Meta(), &exec.JobMeta{
+			Uid:       event.Uid,
+			AuthName:  event.AuthName,
+			Argv:      event.Argv,
+			RpcName:   event.RpcName,
+			HeldSince: event.HeldSince,
+		})
+	}
+	err := jobDispatcher().(DelayDispatcher).DispatchAfter(ctx, event, quotaHoldInterval)
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func quotaId(authName string) string {
+	return "quota." + authName
+}
+
+// drop expired leases
+func pruneLeases(leases map[string]int64, now int64) {
+	for uid, expires := range leases {
+		if expires < now {
+			delete(leases, uid)
+		}
+	}
+}
+
+// update the leases in the quota record by compare and swap, returning
+// false if fn declined to update. quota records have no expiry, so ttl
+// never deletes them, and sweepLeases deletes them once empty.
+func updateLeases(ctx context.Context, authName string, fn func(leases map[string]int64, now int64) bool) bool {
+	id := quotaId(authName)
+	for range quotaAttempts {
+		now := time.Now().Unix()
+		record := tableRecord{}
+		getRecord(ctx, id, &record)
+		leases := map[string]int64{}
+		maps.Copy(leases, record.Leases)
+		pruneLeases(leases, now)
+		if !fn(leases, now) {
+			return false
+		}
+		ok := putRecordIfVersion(ctx, tableRecord{
+			Record: exec.Record{
+				RecordKey: exec.RecordKey{
+					ID: id,
+				},
+			},
+			Leases: leases,
+		}, record.Version)
+		if ok {
+			return true
+		}
+	}
+	panic("too much contention for quota: " + authName)
+}
+
+// take a lease for a job, returning false when the quota is used
+func acquireLease(ctx context.Context, authName, uid string, quota int) bool {
+	return updateLeases(ctx, authName, func(leases map[string]int64, now int64) bool {
+		_, ok := leases[uid]
+		if !ok && len(leases) >= quota {
+			return false
+		}
+		leases[uid] = now + int64(leaseTtl.Seconds())
+		return true
+	})
+}
+
+func releaseLease(ctx context.Context, authName, uid string) {
+	updateLeases(ctx, authName, func(leases map[string]int64, now int64) bool {
+		_, ok := leases[uid]
+		delete(leases, uid)
+		return ok
+	})
+}
+
+func activeLeases(ctx context.Context, authName string) int {
+	record := tableRecord{}
+	getRecord(ctx, quotaId(authName), &record)
+	return len(record.Leases) - countExpired(record.Leases)
+}
+
+func countExpired(leases map[string]int64) int {
+	now := time.Now().Unix()
+	count := 0
+	for _, expires := range leases {
+		if expires < now {
+			count++
+		}
+	}
+	return count
+}
+
+// drop leases held by jobs that died without releasing them, ie lambda
+// timeout, and delete quota records without leases. both are compare
+// and swap on the version, so a lease taken meanwhile is never lost.
+func sweepLeases(ctx context.Context) {
+	count := 0
+	scanRecords(ctx, "quota.", func(decode func(out any)) {
+		record := tableRecord{}
+		decode(&record)
+		stale := countExpired(record.Leases)
+		now := time.Now().Unix()
+		leases := maps.Clone(record.Leases)
+		pruneLeases(leases, now)
+		ok := false
+		switch {
+		case len(leases) == 0:
+			ok = deleteRecordIfVersion(ctx, record.ID, record.Version)
+		case stale > 0:
+			ok = putRecordIfVersion(ctx, tableRecord{
+				Record: exec.Record{
+					RecordKey: record.RecordKey,
+				},
+				Leases: leases,
+			}, record.Version)
+		}
+		if ok { // otherwise a job updated the record, which also prunes
+			count += stale
+		}
+	})
+	if count > 0 {
+		lib.Logger.Println("swept", count, "stale leases")
+	}
+}
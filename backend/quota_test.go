@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// the lease is released once the job finishes
+func TestQuotaLeaseReleased(t *testing.T) {
+	h := newHarness(t)
+	t.Setenv("JOB_QUOTA", "1")
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"true"},
+	})
+	h.lambda.run()
+	if activeLeases(context.Background(), h.authName) != 0 {
+		t.Fatal("lease not released")
+	}
+	_, exit := h.poll(uid)
+	if exit != 0 {
+		t.Fatalf("exit: %d", exit)
+	}
+}
+
+// jobs over quota are parked on a delayed dispatch instead of waiting
+func TestQuotaHold(t *testing.T) {
+	h := newHarness(t)
+	t.Setenv("JOB_QUOTA", "1")
+	t.Setenv("JOB_QUOTA_MODE", "hold")
+	ctx := context.Background()
+	if !acquireLease(ctx, h.authName, "other", 1) {
+		t.Fatal("expected a lease")
+	}
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"echo", "hi"},
+	})
+	h.lambda.run()
+	status, res := h.get(uid, 0)
+	if status != 200 || !res.Held || res.Exit != nil {
+		t.Fatalf("held: %d %#v", status, res)
+	}
+	if h.lambda.unpark() != 1 {
+		t.Fatal("expected one parked job")
+	}
+	h.lambda.run()
+	if h.lambda.unpark() != 1 {
+		t.Fatal("expected the job to be parked again")
+	}
+	releaseLease(ctx, h.authName, "other")
+	h.lambda.run()
+	log, exit := h.poll(uid)
+	if log != "hi\n" || exit != 0 {
+		t.Fatalf("log: %q exit: %d", log, exit)
+	}
+	if h.lambda.unpark() != 0 {
+		t.Fatal("expected no parked jobs")
+	}
+}
+
+// a table whose scan runs a hook after reading each record, like a
+// lease taken between the sweep's read and its write
+type racingTable struct {
+	recordTable
+	hook func()
+}
+
+func (t racingTable) scan(ctx context.Context, prefix string, fn func(decode func(out any) error) error) error {
+	return t.recordTable.scan(ctx, prefix, func(decode func(out any) error) error {
+		err := fn(func(out any) error {
+			err := decode(out)
+			t.hook()
+			return err
+		})
+		return err
+	})
+}
+
+// the sweep never deletes a quota record a lease was just added to
+func TestQuotaSweepRace(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	if !acquireLease(ctx, h.authName, "old", 1) {
+		t.Fatal("expected a lease")
+	}
+	releaseLease(ctx, h.authName, "old")
+	raced := false
+	table = racingTable{recordTable: table, hook: func() {
+		if !raced {
+			raced = true
+			if !acquireLease(ctx, h.authName, "new", 1) {
+				t.Fatal("expected a lease")
+			}
+		}
+	}}
+	sweepLeases(ctx)
+	sweepExpired(ctx)
+	if activeLeases(ctx, h.authName) != 1 {
+		t.Fatal("lease lost to the sweep")
+	}
+}
+
+// hold without a delayed dispatch fails on start, not on submit
+func TestQuotaHoldConfig(t *testing.T) {
+	newHarness(t)
+	t.Setenv("JOB_QUOTA", "1")
+	t.Setenv("JOB_QUOTA_MODE", "hold")
+	CheckConfig()
+	dispatcher = lambdaDispatcher{}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a config error")
+		}
+	}()
+	CheckConfig()
+}
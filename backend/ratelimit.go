@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// per-auth token buckets, configured via env as <count>/<period>, ie
+// RATE_LIMIT_SUBMIT=10/1m allows bursts of 10 submissions, refilling
+// at 10 per minute. an empty value disables the limit.
+const (
+	rateSubmit = "submit" // POST /api/exec, via RATE_LIMIT_SUBMIT
+	ratePoll   = "poll"   // GET /api/exec, via RATE_LIMIT_POLL
+
+	rateAttempts = 5
+)
+
+type rateConfig struct {
+	count  float64
+	period time.Duration
+}
+
+func rateLimitConfig(kind string) (*rateConfig, bool) {
+	val := os.Getenv("RATE_LIMIT_" + strings.ToUpper(kind))
+	if val == "" {
+		return nil, false
+	}
+	count, period, ok := strings.Cut(val, "/")
+	if !ok {
+		panic(fmt.Sprintf("bad rate limit, expected <count>/<period>: %s", val))
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("bad rate limit count: %s", val))
+	}
+	duration, err := exec.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		panic(fmt.Sprintf("bad rate limit period: %s", val))
+	}
+	return &rateConfig{
+		count:  float64(n),
+		period: duration,
+	}, true
+}
+
+// take a token from the bucket for this auth, returning how long to
+// wait when none are available. the bucket is updated by compare and
+// swap on its version, so concurrent lambdas never share a token.
+func rateLimit(ctx context.Context, authName, kind string) (time.Duration, bool) {
+	config, ok := rateLimitConfig(kind)
+	if !ok {
+		return 0, true
+	}
+	id := fmt.Sprintf("ratelimit.%s.%s", kind, authName)
+	perMilli := config.count / float64(config.period.Milliseconds())
+	for range rateAttempts {
+		now := time.Now()
+		bucket := tableRecord{}
+		tokens := config.count
+		if getRecord(ctx, id, &bucket) {
+			elapsed := now.UnixMilli() - bucket.UpdatedAt
+			tokens = math.Min(config.count, bucket.Tokens+float64(max(0, elapsed))*perMilli)
+		}
+		if tokens < 1 {
+			return time.Duration((1-tokens)/perMilli) * time.Millisecond, false
+		}
+		ok := putRecordIfVersion(ctx, tableRecord{
+			Record: exec.Record{
+				RecordKey: exec.RecordKey{
+					ID: id,
+				},
+				RecordData: exec.RecordData{
+					Expires: now.Add(config.period).Unix() + 1, // a missing bucket is a full bucket
+				},
+			},
+			Tokens:    tokens - 1,
+			UpdatedAt: now.UnixMilli(),
+		}, bucket.Version)
+		if ok {
+			return 0, true
+		}
+	}
+	return time.Second, false
+}
@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// the sweep never deletes a bucket refilled after it read the bucket
+func TestRateLimitSweepRace(t *testing.T) {
+	h := newHarness(t)
+	t.Setenv("RATE_LIMIT_SUBMIT", "2/1m")
+	ctx := context.Background()
+	id := "ratelimit." + rateSubmit + "." + h.authName
+	putRecordIfVersion(ctx, tableRecord{
+		Record: exec.Record{
+			RecordKey: exec.RecordKey{
+				ID: id,
+			},
+			RecordData: exec.RecordData{
+				Expires: time.Now().Add(-time.Minute).Unix(),
+			},
+		},
+		UpdatedAt: time.Now().Add(-2 * time.Minute).UnixMilli(),
+	}, 0)
+	raced := false
+	table = racingTable{recordTable: table, hook: func() {
+		if !raced {
+			raced = true
+			_, ok := rateLimit(ctx, h.authName, rateSubmit)
+			if !ok {
+				t.Fatal("expected a token")
+			}
+		}
+	}}
+	sweepExpired(ctx)
+	bucket := tableRecord{}
+	if !getRecord(ctx, id, &bucket) || bucket.Tokens != 1 {
+		t.Fatalf("bucket lost to the sweep: %#v", bucket)
+	}
+}
@@ -0,0 +1,407 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+// the table of records, ie auth, sessions, rate limits, quotas, and
+// audit events. dynamodb in lambda and a file in local mode.
+type recordTable interface {
+	get(ctx context.Context, id string, out any) (bool, error)
+	put(ctx context.Context, record any) error
+	putIfNotExists(ctx context.Context, record any) (bool, error)
+	putIfVersion(ctx context.Context, record tableRecord, version int64) (bool, error)
+	delete(ctx context.Context, id string) error
+	deleteIfVersion(ctx context.Context, id string, version int64) (bool, error)
+	touch(ctx context.Context, id, ip string, now, threshold int64) error
+	bumpVersion(ctx context.Context, id string) error
+	scan(ctx context.Context, prefix string, fn func(decode func(out any) error) error) error
+	ttl() bool // whether the table deletes expired records itself
+}
+
+// a record as stored in the table, with the fields only the backend
+// uses kept out of exec.Record
+type tableRecord struct {
+	exec.Record
+	Csrf      string           `json:"csrf,omitempty" dynamodbav:"csrf,omitempty"`             // for session records
+	Tokens    float64          `json:"tokens,omitempty" dynamodbav:"tokens,omitempty"`         // for rate limit records
+	UpdatedAt int64            `json:"updated-at,omitempty" dynamodbav:"updated-at,omitempty"` // unix millis
+	Leases    map[string]int64 `json:"leases,omitempty" dynamodbav:"leases,omitempty"`         // for quota records, uid to expiry
+	Secret    string           `json:"secret,omitempty" dynamodbav:"secret,omitempty"`         // for sign records, see exec.SignSecret()
+}
+
+// get a record by id from the table, returning false if it does not exist
+func getRecord(ctx context.Context, id string, out any) bool {
+	ok, err := table.get(ctx, id, out)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// put a record unless one with the same id exists, returning false if it does
+func putRecordIfNotExists(ctx context.Context, record any) bool {
+	ok, err := table.putIfNotExists(ctx, record)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// put a record with version one greater than the stored version, which
+// is zero when no record exists, returning false if another writer won
+func putRecordIfVersion(ctx context.Context, record tableRecord, version int64) bool {
+	ok, err := table.putIfVersion(ctx, record, version)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+func deleteRecord(ctx context.Context, id string) {
+	err := table.delete(ctx, id)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// delete a record unless another writer changed its version since it
+// was read, returning false if one did
+func deleteRecordIfVersion(ctx context.Context, id string, version int64) bool {
+	ok, err := table.deleteIfVersion(ctx, id, version)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// record that an auth record was used, skipping the write when another
+// request recorded usage since threshold
+func touchRecord(ctx context.Context, id, ip string, now, threshold int64) {
+	err := table.touch(ctx, id, ip, now, threshold)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// increment the version of a record, ie exec.AuthVersionID
+func bumpRecordVersion(ctx context.Context, id string) {
+	err := table.bumpVersion(ctx, id)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// scan all records with ids starting with prefix, decoding each via decode
+func scanRecords(ctx context.Context, prefix string, fn func(decode func(out any))) {
+	err := table.scan(ctx, prefix, func(decode func(out any) error) error {
+		fn(func(out any) {
+			err := decode(out)
+			if err != nil {
+				panic(err)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// dynamodb deletes expired records via ttl on expires, see infra.yaml
+type dynamoTable struct{}
+
+func (dynamoTable) ttl() bool {
+	return true
+}
+
+// retry dynamodb calls, except when permission is denied, which retrying
+// will not fix
+func retryDynamo(ctx context.Context, fn func() error) error {
+	return lib.Retry(ctx, func() error {
+		err := fn()
+		if err != nil && strings.Contains(err.Error(), "AccessDeniedException") {
+			panic(err)
+		}
+		return err
+	})
+}
+
+func dynamoKey(id string) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMap(exec.RecordKey{
+		ID: id,
+	})
+}
+
+func (dynamoTable) get(ctx context.Context, id string, out any) (bool, error) {
+	key, err := dynamoKey(id)
+	if err != nil {
+		return false, err
+	}
+	var res *dynamodb.GetItemOutput
+	err = retryDynamo(ctx, func() error {
+		var err error
+		res, err = lib.DynamoDBClient().GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(os.Getenv("PROJECT_NAME")),
+			ConsistentRead: aws.Bool(true),
+			Key:            key,
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.Item == nil {
+		return false, nil
+	}
+	err = attributevalue.UnmarshalMap(res.Item, out)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (dynamoTable) put(ctx context.Context, record any) error {
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	return retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(os.Getenv("PROJECT_NAME")),
+			Item:      item,
+		})
+		return err
+	})
+}
+
+func (dynamoTable) putIfNotExists(ctx context.Context, record any) (bool, error) {
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return false, err
+	}
+	exists := false
+	err = retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(os.Getenv("PROJECT_NAME")),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			exists = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+func (dynamoTable) putIfVersion(ctx context.Context, record tableRecord, version int64) (bool, error) {
+	record.Version = version + 1
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return false, err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("PROJECT_NAME")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if version != 0 {
+		input.ConditionExpression = aws.String("version = :version")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: fmt.Sprint(version)},
+		}
+	}
+	conflict := false
+	err = retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().PutItem(ctx, input)
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			conflict = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return !conflict, nil
+}
+
+func (dynamoTable) delete(ctx context.Context, id string) error {
+	key, err := dynamoKey(id)
+	if err != nil {
+		return err
+	}
+	return retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(os.Getenv("PROJECT_NAME")),
+			Key:       key,
+		})
+		return err
+	})
+}
+
+func (dynamoTable) deleteIfVersion(ctx context.Context, id string, version int64) (bool, error) {
+	key, err := dynamoKey(id)
+	if err != nil {
+		return false, err
+	}
+	input := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(os.Getenv("PROJECT_NAME")),
+		Key:                 key,
+		ConditionExpression: aws.String("attribute_not_exists(version)"),
+	}
+	if version != 0 {
+		input.ConditionExpression = aws.String("version = :version")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: fmt.Sprint(version)},
+		}
+	}
+	conflict := false
+	err = retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().DeleteItem(ctx, input)
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			conflict = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return !conflict, nil
+}
+
+func (dynamoTable) touch(ctx context.Context, id, ip string, now, threshold int64) error {
+	key, err := dynamoKey(id)
+	if err != nil {
+		return err
+	}
+	return retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(os.Getenv("PROJECT_NAME")),
+			Key:                 key,
+			UpdateExpression:    aws.String("SET #used = :now, #ip = :ip"),
+			ConditionExpression: aws.String("attribute_exists(id) AND (attribute_not_exists(#used) OR #used < :threshold)"),
+			ExpressionAttributeNames: map[string]string{
+				"#used": "last-used-at",
+				"#ip":   "last-ip",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now":       &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+				":ip":        &types.AttributeValueMemberS{Value: ip},
+				":threshold": &types.AttributeValueMemberN{Value: fmt.Sprint(threshold)},
+			},
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (dynamoTable) bumpVersion(ctx context.Context, id string) error {
+	key, err := dynamoKey(id)
+	if err != nil {
+		return err
+	}
+	return retryDynamo(ctx, func() error {
+		_, err := lib.DynamoDBClient().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(os.Getenv("PROJECT_NAME")),
+			Key:              key,
+			UpdateExpression: aws.String("ADD version :one"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":one": &types.AttributeValueMemberN{Value: "1"},
+			},
+		})
+		return err
+	})
+}
+
+func (dynamoTable) scan(ctx context.Context, prefix string, fn func(decode func(out any) error) error) error {
+	var start map[string]types.AttributeValue
+	for {
+		var out *dynamodb.ScanOutput
+		err := retryDynamo(ctx, func() error {
+			var err error
+			out, err = lib.DynamoDBClient().Scan(ctx, &dynamodb.ScanInput{
+				TableName:         aws.String(os.Getenv("PROJECT_NAME")),
+				ExclusiveStartKey: start,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			id, ok := item["id"].(*types.AttributeValueMemberS)
+			if ok && strings.HasPrefix(id.Value, prefix) {
+				err := fn(func(out any) error {
+					return attributevalue.UnmarshalMap(item, out)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if out.LastEvaluatedKey == nil {
+			return nil
+		}
+		start = out.LastEvaluatedKey
+	}
+}
+
+// delete every record whose expiry has passed, unless the table does
+// it itself. sign records expire with their auth record, so they are
+// deleted together. deletes are compare and swap on the version, so a
+// record renewed after the scan read it survives.
+func sweepExpired(ctx context.Context) {
+	if table.ttl() {
+		return
+	}
+	now := time.Now().Unix()
+	count := 0
+	scanRecords(ctx, "", func(decode func(out any)) {
+		val := exec.Record{}
+		decode(&val)
+		if strings.HasPrefix(val.ID, "quota.") {
+			return // see sweepLeases
+		}
+		if val.Expires != 0 && val.Expires < now {
+			if !deleteRecordIfVersion(ctx, val.ID, val.Version) {
+				return // updated since read, ie a refilled rate limit bucket
+			}
+			count++
+			if strings.HasPrefix(val.ID, "auth.") {
+				deleteRecord(ctx, signIdForAuth(val.ID)) // sign records that predate their expiry
+			}
+		}
+	})
+	if count > 0 {
+		lib.Logger.Println("swept", count, "expired records")
+	}
+}
+
+func expired(expires int64) bool {
+	return expires != 0 && expires < time.Now().Unix()
+}
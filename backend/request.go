@@ -0,0 +1,231 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// an api request, normalized from the event of whichever of api gateway
+// rest, api gateway http, lambda function url, or alb invoked the lambda
+type Request struct {
+	Method          string
+	Path            string
+	Headers         map[string]string // use exec.CaseInsensitiveGet()
+	Query           map[string]string // decoded, the last value of repeated keys
+	PathParameters  map[string]string // set from the route pattern
+	Body            string
+	IsBase64Encoded bool
+	SourceIp        string
+	format          eventFormat
+}
+
+// an api response, encoded for the event format of its request
+type Response struct {
+	StatusCode      int
+	Headers         map[string]string
+	Body            string
+	IsBase64Encoded bool
+}
+
+type eventFormat int
+
+const (
+	formatRest     eventFormat = iota // api gateway rest api, payload 1.0
+	formatHttp                        // api gateway http api and function url, payload 2.0
+	formatAlb                         // alb target group
+	formatAlbMulti                    // alb target group with multi value headers enabled
+)
+
+// parse an api event of any format, returning false for other events
+func parseRequest(event map[string]any) (*Request, bool) {
+	requestContext, _ := event["requestContext"].(map[string]any)
+	_, isAlb := requestContext["elb"]
+	_, hasMethod := event["httpMethod"]
+	_, hasPath := event["path"]
+	switch {
+	case isAlb:
+		return parseAlb(event)
+	case event["version"] == "2.0" && requestContext["http"] != nil:
+		return parseHttp(event)
+	case hasMethod && hasPath:
+		return parseRest(event)
+	default:
+		return nil, false
+	}
+}
+
+func decodeEvent(event map[string]any, v any) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func parseRest(event map[string]any) (*Request, bool) {
+	e := events.APIGatewayProxyRequest{}
+	if !decodeEvent(event, &e) {
+		return nil, false
+	}
+	return &Request{
+		Method:          e.HTTPMethod,
+		Path:            e.Path,
+		Headers:         orEmpty(e.Headers),
+		Query:           orEmpty(e.QueryStringParameters),
+		Body:            e.Body,
+		IsBase64Encoded: e.IsBase64Encoded,
+		SourceIp:        e.RequestContext.Identity.SourceIP,
+		format:          formatRest,
+	}, true
+}
+
+func parseHttp(event map[string]any) (*Request, bool) {
+	e := events.APIGatewayV2HTTPRequest{}
+	if !decodeEvent(event, &e) {
+		return nil, false
+	}
+	headers := orEmpty(e.Headers)
+	if len(e.Cookies) > 0 {
+		headers["cookie"] = strings.Join(e.Cookies, "; ")
+	}
+	// repeated keys are comma joined in QueryStringParameters, so parse
+	// the raw query to match the other formats
+	query := orEmpty(e.QueryStringParameters)
+	values, err := url.ParseQuery(e.RawQueryString)
+	if err == nil {
+		query = lastValues(values)
+	}
+	return &Request{
+		Method:          e.RequestContext.HTTP.Method,
+		Path:            e.RawPath,
+		Headers:         headers,
+		Query:           query,
+		Body:            e.Body,
+		IsBase64Encoded: e.IsBase64Encoded,
+		SourceIp:        e.RequestContext.HTTP.SourceIP,
+		format:          formatHttp,
+	}, true
+}
+
+func parseAlb(event map[string]any) (*Request, bool) {
+	e := events.ALBTargetGroupRequest{}
+	if !decodeEvent(event, &e) {
+		return nil, false
+	}
+	req := &Request{
+		Method:          e.HTTPMethod,
+		Path:            e.Path,
+		Headers:         map[string]string{},
+		Query:           map[string]string{},
+		Body:            e.Body,
+		IsBase64Encoded: e.IsBase64Encoded,
+		format:          formatAlb,
+	}
+	// alb passes query parameters through without decoding them
+	unescape := func(s string) string {
+		x, err := url.QueryUnescape(s)
+		if err != nil {
+			return s
+		}
+		return x
+	}
+	if e.MultiValueHeaders != nil {
+		req.format = formatAlbMulti
+		for k, vs := range e.MultiValueHeaders {
+			sep := ", "
+			if strings.EqualFold(k, "cookie") {
+				sep = "; "
+			}
+			req.Headers[k] = strings.Join(vs, sep)
+		}
+		for k, vs := range e.MultiValueQueryStringParameters {
+			if len(vs) > 0 {
+				req.Query[unescape(k)] = unescape(vs[len(vs)-1])
+			}
+		}
+	} else {
+		for k, v := range e.Headers {
+			req.Headers[k] = v
+		}
+		for k, v := range e.QueryStringParameters {
+			req.Query[unescape(k)] = unescape(v)
+		}
+	}
+	// alb appends the address it received the request from
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, "x-forwarded-for") {
+			parts := strings.Split(v, ",")
+			req.SourceIp = strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	return req, true
+}
+
+func orEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func lastValues(values url.Values) map[string]string {
+	m := map[string]string{}
+	for k, vs := range values {
+		if len(vs) > 0 {
+			m[k] = vs[len(vs)-1]
+		}
+	}
+	return m
+}
+
+// encode the response for the event format that invoked the lambda
+func (r Response) encode(format eventFormat) any {
+	switch format {
+	case formatHttp:
+		headers := map[string]string{}
+		var cookies []string
+		for k, v := range r.Headers {
+			if strings.EqualFold(k, "set-cookie") {
+				cookies = append(cookies, v)
+				continue
+			}
+			headers[k] = v
+		}
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode:      r.StatusCode,
+			Headers:         headers,
+			Cookies:         cookies,
+			Body:            r.Body,
+			IsBase64Encoded: r.IsBase64Encoded,
+		}
+	case formatAlb, formatAlbMulti:
+		res := events.ALBTargetGroupResponse{
+			StatusCode:        r.StatusCode,
+			StatusDescription: fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+			Body:              r.Body,
+			IsBase64Encoded:   r.IsBase64Encoded,
+		}
+		// with multi value headers enabled, alb ignores single value headers
+		if format == formatAlbMulti {
+			res.MultiValueHeaders = map[string][]string{}
+			for k, v := range r.Headers {
+				res.MultiValueHeaders[k] = []string{v}
+			}
+		} else {
+			res.Headers = r.Headers
+		}
+		return res
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode:      r.StatusCode,
+			Headers:         r.Headers,
+			Body:            r.Body,
+			IsBase64Encoded: r.IsBase64Encoded,
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// a synchronous api handler. path parameters are in event.PathParameters.
+// auth is nil for public routes.
+type RouteHandler func(ctx context.Context, event *Request, res chan<- Response, auth *Auth)
+
+type RouteMiddleware func(next RouteHandler) RouteHandler
+
+type Route struct {
+	Method     string            // ie http.MethodGet
+	Pattern    string            // ie /api/jobs/{uid}, where {uid} matches one path segment
+	Handler    RouteHandler      //
+	Public     bool              // skip auth
+	Scope      string            // require scope, or any auth when empty
+	Middleware []RouteMiddleware // applied in order, the first is outermost
+}
+
+var routes []*Route
+
+// register a synchronous api, ie from init() in cmd/ the way rpc
+// functions are registered with exec.Rpc
+func Handle(route *Route) {
+	if !strings.HasPrefix(route.Pattern, "/api/") {
+		panic("route pattern must start with /api/: " + route.Pattern)
+	}
+	if route.Public && route.Scope != "" {
+		panic("public route cannot require scope: " + route.Pattern)
+	}
+	for _, r := range routes {
+		if r.Method == route.Method && r.Pattern == route.Pattern {
+			panic(fmt.Sprintf("duplicate route: %s %s", route.Method, route.Pattern))
+		}
+	}
+	routes = append(routes, route)
+}
+
+// find the route for a request, returning the methods allowed for the
+// path when none match the method
+func matchRoute(method, path string) (*Route, map[string]string, []string) {
+	var allowed []string
+	for _, route := range routes {
+		params, ok := matchPattern(route.Pattern, path)
+		if !ok {
+			continue
+		}
+		if route.Method == method {
+			return route, params, nil
+		}
+		if !slices.Contains(allowed, route.Method) {
+			allowed = append(allowed, route.Method)
+		}
+	}
+	return nil, nil, allowed
+}
+
+func matchPattern(pattern, path string) (map[string]string, bool) {
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(path, "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, part := range patternParts {
+		name, ok := strings.CutPrefix(part, "{")
+		if ok {
+			name, ok = strings.CutSuffix(name, "}")
+		}
+		switch {
+		case ok && pathParts[i] != "":
+			params[name] = pathParts[i]
+		case part != pathParts[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (route *Route) handler() RouteHandler {
+	handler := route.Handler
+	if route.Scope != "" {
+		next := handler
+		handler = func(ctx context.Context, event *Request, res chan<- Response, auth *Auth) {
+			if !auth.HasScope(route.Scope) {
+				res <- errorResponse(Forbidden("missing scope: %s", route.Scope))
+				return
+			}
+			next(ctx, event, res, auth)
+		}
+	}
+	for i := len(route.Middleware) - 1; i >= 0; i-- {
+		handler = route.Middleware[i](handler)
+	}
+	return handler
+}
+
+func methodNotAllowed(allowed []string) Response {
+	return errorResponse(&HttpError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    exec.ErrorCodeMethod,
+		Message: "allowed methods: " + strings.Join(allowed, ", "),
+		Headers: map[string]string{
+			"Allow": strings.Join(allowed, ", "),
+		},
+	})
+}
+
+// take a token from the rate limit bucket of kind for the auth
+func rateLimitMiddleware(kind string) RouteMiddleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(ctx context.Context, event *Request, res chan<- Response, auth *Auth) {
+			retryAfter, ok := rateLimit(ctx, auth.Name, kind)
+			if !ok {
+				res <- errorResponse(RateLimited(retryAfter))
+				return
+			}
+			next(ctx, event, res, auth)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// routes cannot be enumerated without auth
+func TestUnmatchedRoutes(t *testing.T) {
+	h := newHarness(t)
+	status, _ := h.api(http.MethodGet, "/api/missing", nil, nil)
+	if status != 404 {
+		t.Fatalf("missing route: %d", status)
+	}
+	status, _ = h.api(http.MethodDelete, "/api/exec", nil, nil)
+	if status != 405 {
+		t.Fatalf("wrong method: %d", status)
+	}
+	h.auth = exec.RandKey()
+	status, _ = h.api(http.MethodGet, "/api/missing", nil, nil)
+	if status != 401 {
+		t.Fatalf("missing route without auth: %d", status)
+	}
+	status, _ = h.api(http.MethodDelete, "/api/exec", nil, nil)
+	if status != 401 {
+		t.Fatalf("wrong method without auth: %d", status)
+	}
+}
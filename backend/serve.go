@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/aws-exec/store"
+	"github.com/nathants/libaws/lib"
+)
+
+const localMaxBodyBytes = 10 * 1024 * 1024 // like api gateway
+
+// run the backend over net/http without aws, ie for development. jobs
+// and logs are kept under dir/objects, records in dir/records.json, and
+// jobs run in goroutines. url is where clients reach addr, and is used
+// for presigned urls.
+func Serve(addr, dir, url string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+	dirStore := store.NewDir(filepath.Join(dir, "objects"), url)
+	objects = dirStore
+	table = newFileTable(localRecords(dir))
+	auths = tableAuthStore{table: table}
+	dispatcher = goroutineDispatcher{}
+	CheckConfig()
+	ensureLocalAuth(context.Background(), url)
+	go func() {
+		// like the schedule trigger
+		for range time.Tick(5 * time.Minute) {
+			handleEvent(context.Background(), map[string]any{"detail-type": "Scheduled Event"})
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.Handle("/_store/", dirStore)
+	mux.HandleFunc("/", serveHttp)
+	lib.Logger.Println("serving", url, "from", addr, "with state in", dir)
+	return http.ListenAndServe(addr, mux)
+}
+
+// create an auth on first start, so clients work without auth-new
+func ensureLocalAuth(ctx context.Context, url string) {
+	records, err := auths.List(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if len(records) > 0 {
+		return
+	}
+	key := exec.RandKey()
+	_, err = auths.Create(ctx, key, exec.RecordData{
+		Value: "local",
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "created auth, it will not be shown again:\n\nexport PROJECT_URL=%s\nexport AUTH=%s\n\n", url, key)
+}
+
+// translate a request into the same handler calls as the lambda
+func serveHttp(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, localMaxBodyBytes))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	headers := map[string]string{}
+	for k, vs := range r.Header {
+		sep := ", "
+		if k == "Cookie" {
+			sep = "; "
+		}
+		headers[k] = strings.Join(vs, sep)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	res := handleApiRequest(r.Context(), uuid.Must(uuid.NewV4()).String(), &Request{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Headers:  headers,
+		Query:    lastValues(r.URL.Query()),
+		Body:     string(body),
+		SourceIp: ip,
+	})
+	data := []byte(res.Body)
+	if res.IsBase64Encoded {
+		data, err = base64.StdEncoding.DecodeString(res.Body)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for k, v := range res.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(data)
+}
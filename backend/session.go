@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// browser sessions avoid keeping auth in the browser. login exchanges
+// auth for a session token in an HttpOnly cookie, and a csrf token the
+// frontend sends with mutating requests.
+const (
+	sessionCookie = "aws-exec-session"
+	sessionTtl    = 12 * time.Hour
+	headerCsrf    = "csrf-token"
+)
+
+var (
+	errSessionInvalid = errors.New("invalid session")
+	errCsrfInvalid    = errors.New("invalid csrf token")
+)
+
+func sessionId(token string) string {
+	return fmt.Sprintf("session.%s", exec.Blake2b32(token))
+}
+
+func sessionSetCookie(token string, maxAge int) string {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/api/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	return cookie.String()
+}
+
+func sessionToken(event *Request) (string, bool) {
+	header, ok := exec.CaseInsensitiveGet(event.Headers, "cookie")
+	if !ok {
+		return "", false
+	}
+	cookies, err := http.ParseCookie(header)
+	if err != nil {
+		return "", false
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// authenticate via session cookie, requiring the csrf token on mutating requests
+func checkSession(ctx context.Context, event *Request, token, ip string) (*Auth, error) {
+	session, ok := lookupSession(ctx, sessionId(token))
+	if !ok || expired(session.Expires) {
+		return nil, errSessionInvalid
+	}
+	switch event.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		csrf, _ := exec.CaseInsensitiveGet(event.Headers, headerCsrf)
+		if !hmac.Equal([]byte(csrf), []byte(session.Csrf)) {
+			return nil, errCsrfInvalid
+		}
+	}
+	val, ok := lookupAuth(ctx, session.Value)
+	if !ok || val.Value == "" {
+		return nil, errAuthInvalid
+	}
+	if expired(val.Expires) {
+		return nil, errAuthExpired
+	}
+	recordAuthUsage(ctx, val, ip)
+	return newAuth(val), nil
+}
+
+func httpLoginPost(ctx context.Context, event *Request, res chan<- Response, _ *Auth) {
+	key, ok := exec.CaseInsensitiveGet(event.Headers, "auth")
+	if !ok {
+		auditAuthFail(ctx, event, errAuthInvalid)
+		res <- unauthorized(errAuthInvalid)
+		return
+	}
+	auth, err := checkAuth(ctx, key, event.SourceIp)
+	if err != nil {
+		auditAuthFail(ctx, event, err)
+		res <- unauthorized(err)
+		return
+	}
+	token := exec.RandKey()
+	csrf := exec.RandKey()
+	expires := time.Now().Add(sessionTtl).Unix()
+	if auth.Expires != 0 {
+		expires = min(expires, auth.Expires)
+	}
+	ok = putRecordIfNotExists(ctx, tableRecord{
+		Record: exec.Record{
+			RecordKey: exec.RecordKey{
+				ID: sessionId(token),
+			},
+			RecordData: exec.RecordData{
+				Value:     auth.id,
+				Expires:   expires,
+				CreatedAt: time.Now().Unix(),
+			},
+		},
+		Csrf: csrf,
+	})
+	if !ok {
+		panic("session token collision")
+	}
+	e := exec.NewAuditEvent(exec.AuditLogin)
+	e.AuthName = auth.Name
+	e.Ip = event.SourceIp
+	audit(ctx, e)
+	data, err := json.Marshal(exec.LoginResponse{
+		CsrfToken: csrf,
+	})
+	if err != nil {
+		panic(err)
+	}
+	res <- Response{
+		StatusCode: 200,
+		Body:       string(data),
+		Headers: map[string]string{
+			"auth-name":    auth.Name,
+			"Content-Type": "application/json",
+			"Set-Cookie":   sessionSetCookie(token, int(time.Until(time.Unix(expires, 0)).Seconds())),
+		},
+	}
+}
+
+func httpLogoutPost(ctx context.Context, event *Request, res chan<- Response, auth *Auth) {
+	token, ok := sessionToken(event)
+	if ok {
+		// other processes drop the session when their cache entry expires
+		deleteRecord(ctx, sessionId(token))
+		forgetAuth(sessionId(token))
+	}
+	e := exec.NewAuditEvent(exec.AuditLogout)
+	e.AuthName = auth.Name
+	e.Ip = event.SourceIp
+	audit(ctx, e)
+	res <- Response{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"auth-name":  auth.Name,
+			"Set-Cookie": sessionSetCookie("", -1),
+		},
+	}
+}
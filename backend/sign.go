@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+var (
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureStale   = errors.New("stale signature")
+	errSignatureReplay  = errors.New("replayed signature")
+)
+
+// verify a request signed via exec.SignRequest()
+func checkSignature(ctx context.Context, event *Request, ip string) (*Auth, error) {
+	signId, _ := exec.CaseInsensitiveGet(event.Headers, exec.HeaderSignId)
+	timestamp, _ := exec.CaseInsensitiveGet(event.Headers, exec.HeaderSignTimestamp)
+	nonce, _ := exec.CaseInsensitiveGet(event.Headers, exec.HeaderSignNonce)
+	signature, _ := exec.CaseInsensitiveGet(event.Headers, exec.HeaderSignature)
+	if signId == "" || timestamp == "" || nonce == "" || signature == "" {
+		return nil, errSignatureInvalid
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errSignatureInvalid
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > exec.SignWindow || skew < -exec.SignWindow {
+		return nil, errSignatureStale
+	}
+	sign := tableRecord{}
+	ok := getRecord(ctx, "sign."+signId, &sign)
+	if !ok || sign.Secret == "" {
+		return nil, errAuthInvalid
+	}
+	val, ok := lookupAuth(ctx, sign.Value)
+	if !ok || val.Value == "" {
+		return nil, errAuthInvalid
+	}
+	if expired(val.Expires) {
+		return nil, errAuthExpired
+	}
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		body, err = base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return nil, errSignatureInvalid
+		}
+	}
+	expected := exec.Signature(sign.Secret, event.Method, event.Path, exec.CanonicalQuery(event.Query), body, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errSignatureInvalid
+	}
+	// nonces are remembered until the signature would be stale anyway
+	ok = putRecordIfNotExists(ctx, exec.Record{
+		RecordKey: exec.RecordKey{
+			ID: fmt.Sprintf("nonce.%s.%s", signId, nonce),
+		},
+		RecordData: exec.RecordData{
+			Expires: unix + int64(exec.SignWindow.Seconds()),
+		},
+	})
+	if !ok {
+		return nil, errSignatureReplay
+	}
+	recordAuthUsage(ctx, val, ip)
+	return newAuth(val), nil
+}
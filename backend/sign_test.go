@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nathants/aws-exec/exec"
+)
+
+// headers signing a GET with secret, as exec.SignRequest() does with
+// the secret derived from the key
+func signedHeaders(key, secret, method, path string, query map[string]string) map[string]string {
+	timestamp := fmt.Sprint(time.Now().Unix())
+	nonce := exec.RandKey()[:32]
+	return map[string]string{
+		exec.HeaderSignId:        exec.SignId(key),
+		exec.HeaderSignTimestamp: timestamp,
+		exec.HeaderSignNonce:     nonce,
+		exec.HeaderSignature:     exec.Signature(secret, method, path, exec.CanonicalQuery(query), nil, timestamp, nonce),
+	}
+}
+
+func TestSignature(t *testing.T) {
+	h := newHarness(t)
+	uid := h.submit(&exec.PostRequest{
+		Argv: []string{"true"},
+	})
+	h.lambda.run()
+	path := "/api/jobs/" + uid
+	headers := signedHeaders(h.auth, exec.SignSecret(h.auth), http.MethodGet, path, nil)
+	status, body := h.request(http.MethodGet, path, nil, headers, nil)
+	if status != 200 {
+		t.Fatalf("signed: %d %s", status, body)
+	}
+	status, _ = h.request(http.MethodGet, path, nil, headers, nil)
+	if status != 401 {
+		t.Fatalf("replayed: %d", status)
+	}
+	// the auth record id is listed by auth-ls, and must not sign
+	headers = signedHeaders(h.auth, exec.Blake2b32(h.auth), http.MethodGet, path, nil)
+	status, _ = h.request(http.MethodGet, path, nil, headers, nil)
+	if status != 401 {
+		t.Fatalf("signed with record id: %d", status)
+	}
+}
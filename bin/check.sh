@@ -56,6 +56,9 @@ echo go build
 go build -o /dev/null backend/backend.go
 go build -o /dev/null main.go
 
+echo go test
+go test ./...
+
 wait $pid
 echo shadow-cljs compile
 if cat $out | grep -v 'being replaced by: ' | grep -i -e warning -e error &>/dev/null; then
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/nathants/aws-exec/backend"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+func init() {
+	// expose this cmd via the cli
+	lib.Commands["audit-ls"] = auditLs
+	lib.Args["audit-ls"] = auditLsArgs{}
+}
+
+type auditLsArgs struct {
+	Principal string   `arg:"--principal" help:"only events for this principal, or auth name"`
+	Action    []string `arg:"--action,separate" help:"only events with action, repeatable: auth-ok, auth-fail, login, logout, job-submit, auth-new, auth-rm, auth-rotate"`
+	Since     string   `arg:"--since" help:"only events after duration ago or date, ie 24h or 2006-01-02"`
+	Until     string   `arg:"--until" help:"only events before duration ago or date, ie 1h or 2006-01-02"`
+	Json      bool     `arg:"--json" help:"print one json event per line"`
+}
+
+func (auditLsArgs) Description() string {
+	return "\nls audit events, oldest first\n"
+}
+
+func auditLs() {
+	var args auditLsArgs
+	arg.MustParse(&args)
+	since := parseTime(args.Since)
+	until := parseTime(args.Until)
+	all, err := backend.NewAuthStore().ListAudit(context.Background())
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	var auditEvents []*exec.AuditEvent
+	for _, val := range all {
+		if args.Principal != "" && val.Principal() != args.Principal && val.AuthName != args.Principal {
+			continue
+		}
+		if len(args.Action) > 0 && !slices.Contains(args.Action, val.Action) {
+			continue
+		}
+		if !since.IsZero() && val.Time < since.UnixMilli() {
+			continue
+		}
+		if !until.IsZero() && val.Time >= until.UnixMilli() {
+			continue
+		}
+		auditEvents = append(auditEvents, &val)
+	}
+	slices.SortFunc(auditEvents, func(a, b *exec.AuditEvent) int {
+		return strings.Compare(a.ID, b.ID) // ids are ordered by time
+	})
+	for _, val := range auditEvents {
+		if args.Json {
+			fmt.Println(lib.Json(val))
+			continue
+		}
+		fields := []string{
+			time.UnixMilli(val.Time).UTC().Format(time.RFC3339),
+			val.Action,
+			"auth-name=" + dash(val.AuthName),
+			"ip=" + dash(val.Ip),
+		}
+		if val.Request != "" {
+			fields = append(fields, "request="+val.Request)
+		}
+		if val.Reason != "" {
+			fields = append(fields, "reason="+val.Reason)
+		}
+		if val.Uid != "" {
+			fields = append(fields, "uid="+val.Uid)
+		}
+		if val.ParentUid != "" {
+			fields = append(fields, "parent-uid="+val.ParentUid)
+		}
+		if val.RpcName != "" {
+			fields = append(fields, "rpc-name="+val.RpcName)
+		}
+		if len(val.Argv) > 0 {
+			fields = append(fields, "argv="+lib.Json(val.Argv))
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+}
+
+// parse a duration ago or a date, returning zero for empty
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	duration, err := exec.ParseDuration(s)
+	if err == nil {
+		return time.Now().Add(-duration)
+	}
+	date, err := exec.ParseDate(s)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	return date
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/nathants/aws-exec/backend"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+// record an auth change made via the cli in the audit trail. the change
+// has already happened, so a failure is logged without failing the cmd.
+func putAudit(auths backend.AuthStore, action, authName string) {
+	event := exec.NewAuditEvent(action)
+	event.AuthName = authName
+	event.Request = "cli " + action
+	err := auths.Audit(context.Background(), event)
+	if err != nil {
+		lib.Logger.Println("error: audit:", action, err)
+	}
+}
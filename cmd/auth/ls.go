@@ -3,13 +3,11 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/nathants/aws-exec/backend"
 	"github.com/nathants/aws-exec/exec"
 	"github.com/nathants/libaws/lib"
 )
@@ -21,6 +19,8 @@ func init() {
 }
 
 type authLsArgs struct {
+	Json        bool   `arg:"--json" help:"print one json record per line"`
+	UnusedSince string `arg:"--unused-since" help:"only auth not used within duration, ie 90d"`
 }
 
 func (authLsArgs) Description() string {
@@ -30,39 +30,40 @@ func (authLsArgs) Description() string {
 func authLs() {
 	var args authLsArgs
 	arg.MustParse(&args)
-	table := os.Getenv("PROJECT_NAME")
-	var start map[string]types.AttributeValue
-	for {
-		var out *dynamodb.ScanOutput
-		err := lib.Retry(context.Background(), func() error {
-			var err error
-			out, err = lib.DynamoDBClient().Scan(context.Background(), &dynamodb.ScanInput{
-				TableName:         &table,
-				ExclusiveStartKey: start,
-			})
-			if err != nil {
-				if strings.Contains(err.Error(), "AccessDeniedException") {
-					panic(err)
-				}
-			}
-			return err
-		})
+	var unusedSince int64
+	if args.UnusedSince != "" {
+		duration, err := exec.ParseDuration(args.UnusedSince)
 		if err != nil {
 			lib.Logger.Fatal("error: ", err)
 		}
-		for _, item := range out.Items {
-			val := exec.Record{}
-			err := attributevalue.UnmarshalMap(item, &val)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-			if strings.HasPrefix(val.ID, "auth.") {
-				fmt.Println(val.ID, val.Value)
-			}
+		unusedSince = time.Now().Add(-duration).Unix()
+	}
+	records, err := backend.NewAuthStore().List(context.Background())
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	for _, val := range records {
+		if unusedSince != 0 && max(val.LastUsedAt, val.CreatedAt) >= unusedSince {
+			continue
+		}
+		if args.Json {
+			val.Principal = val.AuthPrincipal()
+			fmt.Println(lib.Json(val))
+			continue
 		}
-		if out.LastEvaluatedKey == nil {
-			break
+		scopes := exec.ScopeAdmin
+		if len(val.Scopes) > 0 {
+			scopes = strings.Join(val.Scopes, ",")
 		}
-		start = out.LastEvaluatedKey
+		fmt.Println(
+			val.ID,
+			val.Value,
+			"principal="+val.AuthPrincipal(),
+			"expires="+exec.FormatExpires(val.Expires),
+			"scopes="+scopes,
+			"created-at="+exec.FormatTime(val.CreatedAt),
+			"last-used-at="+exec.FormatTime(val.LastUsedAt),
+			"last-ip="+val.LastIp,
+		)
 	}
 }
@@ -3,13 +3,10 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"os"
-	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/nathants/aws-exec/backend"
 	"github.com/nathants/aws-exec/exec"
 	"github.com/nathants/libaws/lib"
 )
@@ -21,7 +18,10 @@ func init() {
 }
 
 type authNewArgs struct {
-	Name string `arg:"positional,required"`
+	Name    string   `arg:"positional,required"`
+	Ttl     string   `arg:"--ttl" help:"expire after duration, ie 30d or 12h"`
+	Expires string   `arg:"--expires" help:"expire at date, ie 2006-01-02 or RFC3339"`
+	Scope   []string `arg:"--scope,separate" help:"limit to scope, repeatable: admin, jobs:read, exec:argv, rpc:*, rpc:<name>"`
 }
 
 func (authNewArgs) Description() string {
@@ -31,35 +31,40 @@ func (authNewArgs) Description() string {
 func authNew() {
 	var args authNewArgs
 	arg.MustParse(&args)
-	table := os.Getenv("PROJECT_NAME")
-	key := exec.RandKey()
-	item, err := attributevalue.MarshalMap(exec.Record{
-		RecordKey: exec.RecordKey{
-			ID: fmt.Sprintf("auth.%s", exec.Blake2b32(key)),
-		},
-		RecordData: exec.RecordData{
-			Value: args.Name,
-		},
-	})
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	var expires int64
+	switch {
+	case args.Ttl != "" && args.Expires != "":
+		lib.Logger.Fatal("error: provide only one of --ttl or --expires")
+	case args.Ttl != "":
+		ttl, err := exec.ParseDuration(args.Ttl)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		expires = time.Now().Add(ttl).Unix()
+	case args.Expires != "":
+		date, err := exec.ParseDate(args.Expires)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		expires = date.Unix()
 	}
-
-	err = lib.Retry(context.Background(), func() error {
-		_, err := lib.DynamoDBClient().PutItem(context.Background(), &dynamodb.PutItemInput{
-			Item:      item,
-			TableName: aws.String(table),
-		})
+	for _, scope := range args.Scope {
+		err := exec.ValidScope(scope)
 		if err != nil {
-			if strings.Contains(err.Error(), "AccessDeniedException") {
-				panic(err)
-			}
+			lib.Logger.Fatal("error: ", err)
 		}
-		return err
+	}
+	auths := backend.NewAuthStore()
+	key := exec.RandKey()
+	record, err := auths.Create(context.Background(), key, exec.RecordData{
+		Value:   args.Name,
+		Expires: expires,
+		Scopes:  args.Scope,
 	})
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
+	putAudit(auths, exec.AuditAuthNew, record.AuthName())
 
 	fmt.Println(key)
 }
@@ -3,13 +3,10 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/nathants/aws-exec/backend"
 	"github.com/nathants/aws-exec/exec"
 	"github.com/nathants/libaws/lib"
 )
@@ -21,7 +18,9 @@ func init() {
 }
 
 type authRmArgs struct {
-	Auth string `arg:"positional,required"`
+	Auth      string `arg:"positional" help:"auth id, as printed by auth-ls"`
+	Name      string `arg:"--name" help:"rm every auth of the principal with this name"`
+	Principal string `arg:"--principal" help:"rm every auth of this principal, or choose one when name has several"`
 }
 
 func (authRmArgs) Description() string {
@@ -31,30 +30,71 @@ func (authRmArgs) Description() string {
 func authRm() {
 	var args authRmArgs
 	arg.MustParse(&args)
-	table := os.Getenv("PROJECT_NAME")
-	id := args.Auth
-	if !strings.HasPrefix(id, "auth.") {
-		id = fmt.Sprintf("auth.%s", id)
+	if (args.Auth == "") == (args.Name == "" && args.Principal == "") {
+		lib.Logger.Fatal("error: provide one of auth, --name, or --principal")
 	}
-	key, err := attributevalue.MarshalMap(exec.RecordKey{
-		ID: id,
-	})
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
-	}
-	err = lib.Retry(context.Background(), func() error {
-		_, err := lib.DynamoDBClient().DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
-			TableName: aws.String(table),
-			Key:       key,
-		})
+	ctx := context.Background()
+	auths := backend.NewAuthStore()
+	var ids []string
+	names := map[string]string{} // auth id to auth name, for the audit trail
+	if args.Auth == "" {
+		records, err := auths.List(ctx)
 		if err != nil {
-			if strings.Contains(err.Error(), "AccessDeniedException") {
-				panic(err)
+			lib.Logger.Fatal("error: ", err)
+		}
+		principal := args.Principal
+		if args.Name != "" {
+			principals := map[string]bool{}
+			for _, val := range records {
+				if val.Value == args.Name && (args.Principal == "" || val.AuthPrincipal() == args.Principal) {
+					principals[val.AuthPrincipal()] = true
+				}
+			}
+			if len(principals) == 0 {
+				lib.Logger.Fatal("error: no auth for name: ", args.Name)
+			}
+			if len(principals) > 1 {
+				var xs []string
+				for p := range principals {
+					xs = append(xs, p)
+				}
+				lib.Logger.Fatal("error: name has several principals, choose one with --principal: ", strings.Join(xs, " "))
+			}
+			for p := range principals {
+				principal = p
+			}
+		}
+		for _, val := range records {
+			if val.AuthPrincipal() == principal {
+				ids = append(ids, val.ID)
+				names[val.ID] = val.AuthName()
 			}
 		}
-		return err
-	})
+		if len(ids) == 0 {
+			lib.Logger.Fatal("error: no auth for principal: ", principal)
+		}
+	} else {
+		id := args.Auth
+		if !strings.HasPrefix(id, "auth.") {
+			id = fmt.Sprintf("auth.%s", id)
+		}
+		ids = append(ids, id)
+		val, ok, err := auths.Lookup(ctx, id)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		if ok {
+			names[id] = val.AuthName()
+		}
+	}
+	err := auths.Revoke(ctx, ids...)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
+	for _, id := range ids {
+		if args.Auth == "" {
+			fmt.Println("rm", id)
+		}
+		putAudit(auths, exec.AuditAuthRm, names[id])
+	}
 }
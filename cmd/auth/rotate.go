@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/nathants/aws-exec/backend"
+	"github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+func init() {
+	// expose this cmd via the cli
+	lib.Commands["auth-rotate"] = authRotate
+	lib.Args["auth-rotate"] = authRotateArgs{}
+}
+
+type authRotateArgs struct {
+	Name      string `arg:"positional,required"`
+	Principal string `arg:"--principal" help:"which principal to rotate when name has several"`
+	Overlap   string `arg:"--overlap" default:"24h" help:"old keys keep working for this duration, ie 24h or 7d"`
+}
+
+func (authRotateArgs) Description() string {
+	return "\nrotate auth, issuing a new key for the same principal and expiring old keys after the overlap\n"
+}
+
+func authRotate() {
+	var args authRotateArgs
+	arg.MustParse(&args)
+	overlap, err := exec.ParseDuration(args.Overlap)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	ctx := context.Background()
+	auths := backend.NewAuthStore()
+	now := time.Now()
+
+	// find unexpired keys for name
+	all, err := auths.List(ctx)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	var records []exec.Record
+	principals := map[string]bool{}
+	for _, val := range all {
+		if val.Value != args.Name {
+			continue
+		}
+		if val.Expires != 0 && val.Expires < now.Unix() {
+			continue
+		}
+		if args.Principal != "" && val.AuthPrincipal() != args.Principal {
+			continue
+		}
+		records = append(records, val)
+		principals[val.AuthPrincipal()] = true
+	}
+	if len(records) == 0 {
+		lib.Logger.Fatal("error: no auth for name: ", args.Name)
+	}
+	if len(principals) > 1 {
+		var xs []string
+		for principal := range principals {
+			xs = append(xs, principal)
+		}
+		lib.Logger.Fatal("error: name has several principals, choose one with --principal: ", strings.Join(xs, " "))
+	}
+
+	// new key inherits principal, scopes, and expiry from the newest key
+	newest := records[0]
+	for _, record := range records {
+		if record.Expires == 0 || (newest.Expires != 0 && record.Expires > newest.Expires) {
+			newest = record
+		}
+	}
+	key := exec.RandKey()
+	_, err = auths.Create(ctx, key, exec.RecordData{
+		Value:     newest.Value,
+		Principal: newest.AuthPrincipal(),
+		Expires:   newest.Expires,
+		Scopes:    newest.Scopes,
+		CreatedAt: now.Unix(),
+	})
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+
+	// old keys expire after the overlap and are then swept by the schedule trigger
+	revokeAt := now.Add(overlap).Unix()
+	var updates []exec.Record
+	for _, record := range records {
+		if record.Expires == 0 || record.Expires > revokeAt {
+			record.Expires = revokeAt
+			record.Principal = record.AuthPrincipal()
+			updates = append(updates, record)
+		}
+		fmt.Fprintln(os.Stderr, "expires", exec.FormatExpires(record.Expires), record.ID)
+	}
+	err = auths.Update(ctx, updates...)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	putAudit(auths, exec.AuditAuthRotate, newest.AuthName())
+
+	fmt.Println(key)
+}
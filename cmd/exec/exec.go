@@ -31,16 +31,23 @@ usage: bash bin/cli.sh exec ./cli listdir .
 func exec() {
 	var args execArgs
 	arg.MustParse(&args)
+	bar := awsexec.NewProgressBar()
 	exitCode, err := awsexec.Exec(context.Background(), &awsexec.Args{
-		Url:  fmt.Sprintf("https://%s", os.Getenv("PROJECT_DOMAIN")),
+		Url:  awsexec.ProjectUrl(),
 		Auth: os.Getenv("AUTH"),
+		Sign: os.Getenv("AUTH_SIGN") != "",
 		Argv: args.Argv,
 		LogDataCallback: func(logs string) {
-			fmt.Print(logs)
+			bar.Log(func() {
+				fmt.Print(logs)
+			})
 		},
+		ProgressCallback: bar.Update,
 	})
+	bar.Done()
 	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+		lib.Logger.Println("error:", err)
+		os.Exit(awsexec.ExitCode(err))
 	}
 	os.Exit(exitCode)
 }
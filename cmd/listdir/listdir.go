@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"net/http"
 	"path/filepath"
 	"strings"
 
 	"github.com/alexflint/go-arg"
+	"github.com/nathants/aws-exec/backend"
 	awsexec "github.com/nathants/aws-exec/exec"
 	"github.com/nathants/libaws/lib"
 )
@@ -27,6 +29,37 @@ func init() {
 		}
 		return Listdir(ctx, println, &args)
 	}
+
+	// expose the cmd via sync api, ie GET /api/listdir?path=. the rpc
+	// is called through the same middleware as async and cli calls.
+	backend.Handle(&backend.Route{
+		Method:  http.MethodGet,
+		Pattern: "/api/listdir",
+		Scope:   awsexec.ScopeRpcPrefix + "listdir",
+		Handler: backend.JSON(func(ctx context.Context, auth *backend.Auth, args *listdirArgs) (*[]string, error) {
+			if args.Path == "" {
+				args.Path = "."
+			}
+			argsJson, err := json.Marshal(args)
+			if err != nil {
+				return nil, err
+			}
+			paths := []string{}
+			err = awsexec.CallRpc(ctx, &awsexec.RpcCall{
+				Name:     "listdir",
+				ArgsJson: string(argsJson),
+				AuthName: auth.Name,
+				Uid:      backend.RequestId(ctx),
+				Println: func(v ...any) {
+					paths = append(paths, fmt.Sprint(v...))
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &paths, nil
+		}),
+	})
 }
 
 type listdirArgs struct {
@@ -40,11 +73,19 @@ func (listdirArgs) Description() string {
 func listdir() {
 	var args listdirArgs
 	arg.MustParse(&args)
-	ctx := context.Background()
-	println := func(v ...any) {
-		fmt.Println(v...)
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
 	}
-	err := Listdir(ctx, println, &args)
+	err = awsexec.CallRpc(context.Background(), &awsexec.RpcCall{
+		Name:     "listdir",
+		ArgsJson: string(argsJson),
+		AuthName: "local",
+		Uid:      "-",
+		Println: func(v ...any) {
+			fmt.Println(v...)
+		},
+	})
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+	awsexec "github.com/nathants/aws-exec/exec"
+	"github.com/nathants/libaws/lib"
+)
+
+func init() {
+	// expose this cmd via the cli
+	lib.Commands["rpc-map"] = rpcMap
+	lib.Args["rpc-map"] = rpcMapArgs{}
+}
+
+type rpcMapArgs struct {
+	RpcName     string `arg:"positional,required"`
+	Concurrency int    `arg:"-c,--concurrency" default:"16"`
+}
+
+func (rpcMapArgs) Description() string {
+	return `
+invoke command via rpc once per line of json args on stdin
+
+usage: bash bin/cli.sh rpc-map listdir < args.jsonl
+`
+}
+
+func rpcMap() {
+	var args rpcMapArgs
+	arg.MustParse(&args)
+	var argsJson []string
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rpcArgs := map[string]any{}
+		err := json.Unmarshal([]byte(line), &rpcArgs)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		argsJson = append(argsJson, line)
+	}
+	err := scanner.Err()
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	results, err := awsexec.Map(context.Background(), &awsexec.Args{
+		Url:     awsexec.ProjectUrl(),
+		Auth:    os.Getenv("AUTH"),
+		Sign:    os.Getenv("AUTH_SIGN") != "",
+		RpcName: args.RpcName,
+		LogDataCallback: func(logs string) {
+			fmt.Print(logs)
+		},
+	}, argsJson, args.Concurrency)
+	fmt.Print(awsexec.FormatMapResults(results))
+	if err != nil {
+		lib.Logger.Println("error:", err)
+		os.Exit(awsexec.ExitCode(err))
+	}
+	for _, result := range results {
+		if result.Exit != 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -38,17 +38,24 @@ func rpc() {
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
+	bar := awsexec.NewProgressBar()
 	exitCode, err := awsexec.Exec(context.Background(), &awsexec.Args{
-		Url:     fmt.Sprintf("https://%s", os.Getenv("PROJECT_DOMAIN")),
+		Url:     awsexec.ProjectUrl(),
 		Auth:    os.Getenv("AUTH"),
+		Sign:    os.Getenv("AUTH_SIGN") != "",
 		RpcName: args.RpcName,
 		RpcArgs: args.RpcArgsJson,
 		LogDataCallback: func(logs string) {
-			fmt.Print(logs)
+			bar.Log(func() {
+				fmt.Print(logs)
+			})
 		},
+		ProgressCallback: bar.Update,
 	})
+	bar.Done()
 	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+		lib.Logger.Println("error:", err)
+		os.Exit(awsexec.ExitCode(err))
 	}
 	os.Exit(exitCode)
 }
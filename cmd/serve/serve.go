@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/alexflint/go-arg"
+	"github.com/nathants/aws-exec/backend"
+	"github.com/nathants/libaws/lib"
+)
+
+func init() {
+	// expose this cmd via the cli
+	lib.Commands["serve"] = serve
+	lib.Args["serve"] = serveArgs{}
+}
+
+type serveArgs struct {
+	Addr string `arg:"--addr" default:":8080" help:"address to listen on"`
+	Dir  string `arg:"--dir" default:".aws-exec" help:"local state, ie job logs and auth"`
+	Url  string `arg:"--url" help:"url clients use to reach addr, default http://localhost<addr>"`
+}
+
+func (serveArgs) Description() string {
+	return `
+run the backend locally without aws
+
+usage: aws-exec serve --addr :8080
+`
+}
+
+func serve() {
+	var args serveArgs
+	arg.MustParse(&args)
+	url := args.Url
+	if url == "" {
+		host := args.Addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		url = "http://" + host
+	}
+	err := backend.Serve(args.Addr, args.Dir, url)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+}
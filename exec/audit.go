@@ -0,0 +1,57 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// actions recorded in the audit trail
+const (
+	AuditAuthOk     = "auth-ok"   // recorded at most every 5 minutes per auth and ip
+	AuditAuthFail   = "auth-fail" // any rejected credential, with a reason
+	AuditLogin      = "login"
+	AuditLogout     = "logout"
+	AuditJobSubmit  = "job-submit"
+	AuditAuthNew    = "auth-new"
+	AuditAuthRm     = "auth-rm"
+	AuditAuthRotate = "auth-rotate"
+)
+
+// audit events are append-only records in the table with ids prefixed
+// by audit. and ordered by time. they expire after AUDIT_RETENTION,
+// default 90d, and are swept like other expired records.
+type AuditEvent struct {
+	RecordKey
+	Time      int64    `json:"time" dynamodbav:"time"` // unix millis
+	Action    string   `json:"action" dynamodbav:"action"`
+	AuthName  string   `json:"auth-name,omitempty" dynamodbav:"auth-name,omitempty"` // name:principal
+	Ip        string   `json:"ip,omitempty" dynamodbav:"ip,omitempty"`
+	Request   string   `json:"request,omitempty" dynamodbav:"request,omitempty"` // ie POST /api/exec
+	Reason    string   `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Uid       string   `json:"uid,omitempty" dynamodbav:"uid,omitempty"`
+	ParentUid string   `json:"parent-uid,omitempty" dynamodbav:"parent-uid,omitempty"`
+	Argv      []string `json:"argv,omitempty" dynamodbav:"argv,omitempty"`
+	RpcName   string   `json:"rpc-name,omitempty" dynamodbav:"rpc-name,omitempty"`
+	Expires   int64    `json:"expires,omitempty" dynamodbav:"expires,omitempty"` // unix seconds
+}
+
+func NewAuditEvent(action string) *AuditEvent {
+	now := time.Now()
+	return &AuditEvent{
+		RecordKey: RecordKey{
+			ID: fmt.Sprintf("audit.%d.%s", now.UnixNano(), RandKey()[:8]),
+		},
+		Time:   now.UnixMilli(),
+		Action: action,
+	}
+}
+
+// the principal from the auth name, or empty when unknown
+func (e *AuditEvent) Principal() string {
+	i := strings.LastIndex(e.AuthName, ":")
+	if i == -1 {
+		return ""
+	}
+	return e.AuthName[i+1:]
+}
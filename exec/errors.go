@@ -0,0 +1,137 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// error codes in the json body of api errors, so clients can branch on them
+const (
+	ErrorCodeBadRequest    = "bad-request"
+	ErrorCodeUnauthorized  = "unauthorized"
+	ErrorCodeForbidden     = "forbidden"
+	ErrorCodeNotFound      = "not-found"
+	ErrorCodeMethod        = "method-not-allowed"
+	ErrorCodeConflict      = "conflict"
+	ErrorCodeRateLimited   = "rate-limited"
+	ErrorCodeQuotaExceeded = "quota-exceeded"
+	ErrorCodeServerError   = "server-error"
+)
+
+// the body of every api error
+type ErrorResponse struct {
+	Error   string `json:"error"` // one of ErrorCode*
+	Message string `json:"message"`
+}
+
+// errors returned by Exec() wrap one of these, for errors.Is()
+var (
+	ErrUnauthorized = errors.New("unauthorized")      // 401, bad or expired auth
+	ErrForbidden    = errors.New("forbidden")         // 403, ie missing scope
+	ErrNotFound     = errors.New("not found")         // 404, ie rpc not found
+	ErrValidation   = errors.New("validation failed") // 400, ie bad args
+	ErrRateLimited  = errors.New("rate limited")      // 429, rate limit or job quota
+	ErrJobLost      = errors.New("job lost")          // the job stopped without an exit code
+	ErrServer       = errors.New("server error")      // 5xx
+)
+
+// an error response from the api, for errors.As()
+type Error struct {
+	StatusCode int
+	Code       string // one of ErrorCode*, when the body is an ErrorResponse
+	Message    string
+	Body       string
+	RequestId  string // see HeaderRequestId
+	Method     string
+	Path       string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Body
+	}
+	return fmt.Sprintf("%d %s %s %s (request-id: %s)", e.StatusCode, e.Method, e.Path, msg, e.RequestId)
+}
+
+func (e *Error) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrValidation
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServer
+	default:
+		return nil
+	}
+}
+
+func responseError(out *http.Response, data []byte) error {
+	e := &Error{
+		StatusCode: out.StatusCode,
+		Body:       strings.TrimSpace(string(data)),
+		RequestId:  out.Header.Get(HeaderRequestId),
+		Method:     out.Request.Method,
+		Path:       out.Request.URL.Path,
+	}
+	body := ErrorResponse{}
+	if json.Unmarshal(data, &body) == nil {
+		e.Code = body.Error
+		e.Message = body.Message
+	}
+	return e
+}
+
+// errors that will not go away by trying again. a lost job stays lost,
+// so polling its uid again would only wait out JobLostTimeout again.
+func permanent(err error) bool {
+	return errors.Is(err, ErrUnauthorized) ||
+		errors.Is(err, ErrForbidden) ||
+		errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrValidation) ||
+		errors.Is(err, ErrJobLost)
+}
+
+// exit codes for cli commands that fail before the job exits, chosen
+// to be unlikely exit codes of the job itself
+const (
+	ExitUnauthorized = 80
+	ExitForbidden    = 81
+	ExitNotFound     = 82
+	ExitValidation   = 83
+	ExitRateLimited  = 84
+	ExitJobLost      = 85
+	ExitServer       = 86
+	ExitOther        = 87
+)
+
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return ExitUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return ExitForbidden
+	case errors.Is(err, ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, ErrValidation):
+		return ExitValidation
+	case errors.Is(err, ErrRateLimited):
+		return ExitRateLimited
+	case errors.Is(err, ErrJobLost):
+		return ExitJobLost
+	case errors.Is(err, ErrServer):
+		return ExitServer
+	default:
+		return ExitOther
+	}
+}
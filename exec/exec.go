@@ -6,15 +6,16 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nathants/aws-exec/store"
 	"github.com/nathants/libaws/lib"
 	"golang.org/x/crypto/blake2b"
 )
@@ -23,10 +24,27 @@ type rpcFunc func(ctx context.Context, println func(v ...any), argsJson string)
 
 var Rpc = map[string]rpcFunc{}
 
+const (
+	ScopeAdmin     = "admin"     // everything
+	ScopeJobsRead  = "jobs:read" // poll jobs
+	ScopeExecArgv  = "exec:argv" // submit subprocess jobs
+	ScopeRpcPrefix = "rpc:"      // submit rpc jobs, ie rpc:listdir, or rpc:* for any rpc
+	ScopeNone      = "none"      // nothing, since no scopes is all-powerful
+)
+
+// the response header with the id of the request, also found in
+// service logs and in errors returned by Exec()
+const HeaderRequestId = "request-id"
+
+// the record whose version is incremented when auth is revoked, which
+// invalidates auth cached by the backend
+const AuthVersionID = "authversion"
+
 const (
 	EventExec       = "exec"
 	MaxLogBytes     = 1024 * 1024 * 32 // reasonably upper bound to write to s3 from 128mb lambda
 	LogShipInterval = 1 * time.Second
+	JobLostTimeout  = 16 * time.Minute // jobs run at most 14 minutes, so a job silent for longer is lost
 )
 
 type GetRequest struct {
@@ -34,9 +52,41 @@ type GetRequest struct {
 	RangeStart int    `json:"range-start"`
 }
 
+func (r *GetRequest) Validate() error {
+	if r.Uid == "" || strings.Contains(r.Uid, "/") {
+		return fmt.Errorf("bad uid: %q", r.Uid)
+	}
+	if r.RangeStart < 0 {
+		return fmt.Errorf("bad range-start: %d", r.RangeStart)
+	}
+	return nil
+}
+
 type GetResponse struct {
-	Exit *int   `json:"exit"`
-	Url  string `json:"url"`
+	Exit     *int         `json:"exit"`
+	Url      string       `json:"url"`
+	Progress *JobProgress `json:"progress,omitempty"`
+	Held     bool         `json:"held,omitempty"` // waiting for job quota
+}
+
+// progress reported by an rpc function via Progress()
+type JobProgress struct {
+	Done    int    `json:"done"`
+	Total   int    `json:"total"`
+	Message string `json:"message"`
+}
+
+// job metadata persisted next to log, size, and exit
+type JobMeta struct {
+	Uid       string       `json:"uid"`
+	AuthName  string       `json:"auth-name"`
+	Argv      []string     `json:"argv,omitempty"`
+	RpcName   string       `json:"rpc-name,omitempty"`
+	ParentUid string       `json:"parent-uid,omitempty"`
+	Started   int64        `json:"started"`
+	Progress  *JobProgress `json:"progress,omitempty"`
+	Result    string       `json:"result,omitempty"`
+	HeldSince int64        `json:"held-since,omitempty"` // set while waiting for job quota, before started
 }
 
 // s3 presigned put urls
@@ -57,14 +107,33 @@ type PostRequest struct {
 	RpcArgs string `json:"rpc-args"`
 }
 
+func (r *PostRequest) Validate() error {
+	if (len(r.Argv) == 0) == (r.RpcName == "") {
+		return fmt.Errorf("provide one of argv or rpc-name")
+	}
+	if r.PushUrls != nil && (r.PushUrls.Log == "" || r.PushUrls.Size == "" || r.PushUrls.Exit == "") {
+		return fmt.Errorf("push-urls needs log, size, and exit")
+	}
+	return nil
+}
+
 type PostResponse struct {
 	Uid string `json:"uid"`
 }
 
+// login exchanges auth for a session cookie. mutating requests with
+// the session cookie must send the csrf token in the csrf-token header.
+type LoginResponse struct {
+	CsrfToken string `json:"csrf-token"`
+}
+
 type AsyncEvent struct {
 	EventType string    `json:"event-type"`
 	AuthName  string    `json:"auth-name"`
 	Uid       string    `json:"uid"`
+	ParentUid string    `json:"parent-uid,omitempty"` // set when launched via Fanout()
+	HeldSince int64     `json:"held-since,omitempty"` // set while waiting for job quota
+	Scopes    []string  `json:"scopes,omitempty"`     // of the submitting auth, checked for Fanout() children
 	PushUrls  *PushUrls `json:"push-urls"`
 
 	// to invoke subprocess, provide argv. this is slower.
@@ -80,7 +149,14 @@ type RecordKey struct {
 }
 
 type RecordData struct {
-	Value string `json:"value" dynamodbav:"value"`
+	Value      string   `json:"value" dynamodbav:"value"`
+	Principal  string   `json:"principal,omitempty" dynamodbav:"principal,omitempty"`   // stable across key rotation, owns jobs
+	Expires    int64    `json:"expires,omitempty" dynamodbav:"expires,omitempty"`       // unix seconds, zero never expires
+	Scopes     []string `json:"scopes,omitempty" dynamodbav:"scopes,omitempty"`         // empty is all-powerful, like admin
+	CreatedAt  int64    `json:"created-at,omitempty" dynamodbav:"created-at,omitempty"` // unix seconds
+	LastUsedAt int64    `json:"last-used-at,omitempty" dynamodbav:"last-used-at,omitempty"`
+	LastIp     string   `json:"last-ip,omitempty" dynamodbav:"last-ip,omitempty"`
+	Version    int64    `json:"version,omitempty" dynamodbav:"version,omitempty"` // see AuthVersionID
 }
 
 type Record struct {
@@ -88,11 +164,27 @@ type Record struct {
 	RecordData
 }
 
+// the principal for an auth record. records that predate principals
+// use the prefix of their key hash, which is what new records use too.
+func (r *Record) AuthPrincipal() string {
+	if r.Principal != "" {
+		return r.Principal
+	}
+	return strings.TrimPrefix(r.ID, "auth.")[:16]
+}
+
+// the name that prefixes jobs owned by an auth record
+func (r *Record) AuthName() string {
+	return r.Value + ":" + r.AuthPrincipal()
+}
+
 type Args struct {
-	Url             string
-	Auth            string
-	LogDataCallback func(logs string)
-	PushUrls        *PushUrls
+	Url              string
+	Auth             string
+	Sign             bool // sign requests with auth instead of sending it, see SignRequest()
+	LogDataCallback  func(logs string)
+	ProgressCallback func(progress *JobProgress) // optional, invoked when progress changes
+	PushUrls         *PushUrls
 
 	// to invoke subprocess, provide argv. this is slower.
 	Argv []string
@@ -102,7 +194,7 @@ type Args struct {
 	RpcArgs string
 }
 
-// s3 keys to pull data from
+// keys to pull data from
 type PullKeys struct {
 	Log  string
 	Size string
@@ -110,12 +202,35 @@ type PullKeys struct {
 }
 
 type TailArgs struct {
-	PullBucket      string    // s3 bucket to pull data from
-	PullKeys        *PullKeys // s3 keys to pull data from
+	PullBucket      string      // s3 bucket to pull data from, unless Store is set
+	Store           store.Store // optional store to pull data from, ie store.NewDir()
+	PullKeys        *PullKeys   // keys to pull data from, see store.Job()
 	LogShipInterval time.Duration
 	LogDataCallback func(logs string)
 }
 
+type progressKey struct{}
+
+// used by the backend to receive progress from rpc functions
+func WithProgress(ctx context.Context, fn func(progress *JobProgress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// report progress from an rpc function. progress is persisted with
+// the job metadata and returned to callers polling the job. when
+// invoked outside of the backend, ie via the cli, this does nothing.
+func Progress(ctx context.Context, done, total int, message string) {
+	fn, ok := ctx.Value(progressKey{}).(func(progress *JobProgress))
+	if !ok {
+		return
+	}
+	fn(&JobProgress{
+		Done:    done,
+		Total:   total,
+		Message: message,
+	})
+}
+
 func Blake2b32(x string) string {
 	val := blake2b.Sum256([]byte(x))
 	return hex.EncodeToString(val[:])
@@ -130,6 +245,92 @@ func RandKey() string {
 	return hex.EncodeToString(val)
 }
 
+// check that scopes grant want. keys without scopes predate scopes
+// and are all-powerful. any scope that submits jobs can also poll
+// them, since clients need to follow the jobs they submit.
+func HasScope(scopes []string, want string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		switch {
+		case scope == ScopeAdmin:
+			return true
+		case scope == want:
+			return true
+		case scope == ScopeRpcPrefix+"*" && strings.HasPrefix(want, ScopeRpcPrefix):
+			return true
+		case want == ScopeJobsRead && (scope == ScopeExecArgv || strings.HasPrefix(scope, ScopeRpcPrefix)):
+			return true
+		}
+	}
+	return false
+}
+
+func ValidScope(scope string) error {
+	switch scope {
+	case ScopeAdmin, ScopeJobsRead, ScopeExecArgv, ScopeRpcPrefix + "*":
+		return nil
+	}
+	name, ok := strings.CutPrefix(scope, ScopeRpcPrefix)
+	if ok {
+		_, ok = Rpc[name]
+		if !ok {
+			return fmt.Errorf("no such rpc for scope: %s", scope)
+		}
+		return nil
+	}
+	return fmt.Errorf("bad scope, expected one of %s, %s, %s, %s*, %s<name>: %s", ScopeAdmin, ScopeJobsRead, ScopeExecArgv, ScopeRpcPrefix, ScopeRpcPrefix, scope)
+}
+
+// parse a duration like time.ParseDuration, additionally accepting days, ie 30d
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("bad duration: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parse a date like 2006-01-02 or an RFC3339 timestamp
+func ParseDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad date, expected 2006-01-02 or RFC3339: %s", s)
+}
+
+func FormatExpires(expires int64) string {
+	if expires == 0 {
+		return "never"
+	}
+	return FormatTime(expires)
+}
+
+func FormatTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// the url of the deployment, PROJECT_URL or https://PROJECT_DOMAIN
+func ProjectUrl() string {
+	url := os.Getenv("PROJECT_URL")
+	if url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "https://" + os.Getenv("PROJECT_DOMAIN")
+}
+
 func CaseInsensitiveGet(m map[string]string, k string) (string, bool) {
 	for mk, mv := range m {
 		if strings.EqualFold(mk, k) {
@@ -139,6 +340,59 @@ func CaseInsensitiveGet(m map[string]string, k string) (string, bool) {
 	return "", false
 }
 
+func setAuth(req *http.Request, args *Args, body []byte) {
+	if args.Sign {
+		SignRequest(req, args.Auth, body)
+	} else {
+		req.Header.Set("auth", args.Auth)
+	}
+}
+
+// do a request and read the response body. when rate limited, wait for
+// Retry-After and make a new request, which is signed again if signing.
+// a 429 without Retry-After, ie job quota, is returned to the caller.
+func doRequest(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, []byte, error) {
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+		out, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(out.Body)
+		_ = out.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		header := out.Header.Get("Retry-After")
+		if out.StatusCode != http.StatusTooManyRequests || header == "" {
+			return out, data, nil
+		}
+		wait := retryAfter(header)
+		lib.Logger.Println("rate limited, retrying in", wait)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// parse Retry-After as seconds or a http date, defaulting to one second
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(header)
+	if err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return time.Second
+}
+
 // if pushUrls are not provided, data will be persisted by aws-exec and
 // this function will poll until process completion, pulling log data
 // as it is available and invoking logDataCallback, then returning the
@@ -151,6 +405,26 @@ func CaseInsensitiveGet(m map[string]string, k string) (string, bool) {
 // once and will contain the exit code. size will be pushed once, will
 // be pushed last, and will contain the size of the final log push.
 func Exec(ctx context.Context, args *Args) (int, error) {
+	_, exit, err := execUid(ctx, args)
+	return exit, err
+}
+
+// Exec() that also returns the uid of the job once it was submitted
+func execUid(ctx context.Context, args *Args) (string, int, error) {
+	uid, err := submitJob(ctx, args)
+	if err != nil {
+		return "", -1, err
+	}
+	if args.PushUrls != nil {
+		return uid, -1, nil
+	}
+	rangeStart := 0
+	exit, err := pollJob(ctx, args, uid, &rangeStart)
+	return uid, exit, err
+}
+
+// post the job, returning its uid
+func submitJob(ctx context.Context, args *Args) (string, error) {
 	postResponse := PostResponse{}
 	var expectedErr error
 	err := lib.RetryAttempts(ctx, 7, func() error {
@@ -164,17 +438,14 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 		if err != nil {
 			return err
 		}
-		req, err := http.NewRequest(http.MethodPost, args.Url+"/api/exec", bytes.NewReader(data))
-		req.Header.Set("auth", args.Auth)
-		if err != nil {
-			return err
-		}
-		out, err := client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer func() { _ = out.Body.Close() }()
-		data, err = io.ReadAll(out.Body)
+		out, data, err := doRequest(ctx, &client, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPost, args.Url+"/api/exec", bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			setAuth(req, args, data)
+			return req, nil
+		})
 		if err != nil {
 			return err
 		}
@@ -186,43 +457,56 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 			return nil
 		}
 		if fmt.Sprint(out.StatusCode)[:1] == "5" {
-			return fmt.Errorf("%d %s", out.StatusCode, string(data))
+			return responseError(out, data)
 		}
-		expectedErr = fmt.Errorf("%d %s", out.StatusCode, string(data))
+		expectedErr = responseError(out, data)
 		return nil
 	})
 	if expectedErr != nil {
 		lib.Logger.Println("error:", expectedErr)
-		return -1, expectedErr
+		return "", expectedErr
 	}
 	if err != nil {
 		lib.Logger.Println("error:", err)
-		return -1, err
-	}
-	if args.PushUrls != nil {
-		return -1, nil
+		return "", err
 	}
-	rangeStart := 0
+	return postResponse.Uid, nil
+}
+
+// follow the log of a submitted job from rangeStart until it exits,
+// returning the exit code. rangeStart is advanced as log data is read,
+// so polling can resume after an error without repeating the log.
+func pollJob(ctx context.Context, args *Args, uid string, rangeStart *int) (int, error) {
+	var lastProgress *JobProgress
+	lastAlive := time.Now()
 	for {
+		if time.Since(lastAlive) > JobLostTimeout {
+			err := fmt.Errorf("%w: no exit or output for %s, uid: %s", ErrJobLost, JobLostTimeout, uid)
+			lib.Logger.Println("error:", err)
+			return -1, err
+		}
 		getResp := GetResponse{}
+		var permanentErr error
 		err := lib.RetryAttempts(ctx, 7, func() error {
 			client := http.Client{}
-			req, err := http.NewRequest(http.MethodGet, args.Url+fmt.Sprintf("/api/exec?uid=%s&range-start=%d", postResponse.Uid, rangeStart), nil)
-			if err != nil {
-				return err
-			}
-			req.Header.Set("auth", args.Auth)
-			out, err := client.Do(req)
-			if err != nil {
-				return err
-			}
-			defer func() { _ = out.Body.Close() }()
-			data, err := io.ReadAll(out.Body)
+			out, data, err := doRequest(ctx, &client, func() (*http.Request, error) {
+				req, err := http.NewRequest(http.MethodGet, args.Url+fmt.Sprintf("/api/exec?uid=%s&range-start=%d", uid, *rangeStart), nil)
+				if err != nil {
+					return nil, err
+				}
+				setAuth(req, args, nil)
+				return req, nil
+			})
 			if err != nil {
 				return err
 			}
 			if out.StatusCode != 200 {
-				return fmt.Errorf("%d %s\n%s", out.StatusCode, out.Request.URL, string(data))
+				err := responseError(out, data)
+				if permanent(err) {
+					permanentErr = err
+					return nil
+				}
+				return err
 			}
 			err = json.Unmarshal(data, &getResp)
 			if err != nil {
@@ -230,10 +514,23 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 			}
 			return nil
 		})
+		if err == nil {
+			err = permanentErr
+		}
 		if err != nil {
 			lib.Logger.Println("error:", err)
 			return -1, err
 		}
+		if getResp.Progress != nil && (lastProgress == nil || *lastProgress != *getResp.Progress) {
+			lastProgress = getResp.Progress
+			lastAlive = time.Now()
+			if args.ProgressCallback != nil {
+				args.ProgressCallback(getResp.Progress)
+			}
+		}
+		if getResp.Held {
+			lastAlive = time.Now() // waiting for job quota
+		}
 		if getResp.Exit != nil {
 			return *getResp.Exit, nil
 		}
@@ -243,7 +540,7 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 			if err != nil {
 				return err
 			}
-			req.Header.Set("range", fmt.Sprintf("bytes=%d-", rangeStart))
+			req.Header.Set("range", fmt.Sprintf("bytes=%d-", *rangeStart))
 			out, err := http.DefaultClient.Do(req)
 			if err != nil {
 				return err
@@ -276,7 +573,8 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 		}
 		if len(data) > 0 {
 			args.LogDataCallback(string(data))
-			rangeStart += len(data)
+			*rangeStart += len(data)
+			lastAlive = time.Now()
 		}
 	}
 }
@@ -284,6 +582,10 @@ func Exec(ctx context.Context, args *Args) (int, error) {
 // if pushUrls were provided to Exec(), you can use Tail() to follow
 // the output and return the exit code.
 func Tail(ctx context.Context, tailArgs *TailArgs) (int, error) {
+	objects := tailArgs.Store
+	if objects == nil {
+		objects = store.NewS3(tailArgs.PullBucket)
+	}
 	rangeStart := 0
 	for {
 		select {
@@ -294,57 +596,25 @@ func Tail(ctx context.Context, tailArgs *TailArgs) (int, error) {
 		default:
 		}
 		// once size is known and client has read size bytes, return exit
-		var sizeData []byte
-		_ = lib.Retry(ctx, func() error {
-			outSize, err := lib.S3Client().GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(tailArgs.PullBucket),
-				Key:    aws.String(tailArgs.PullKeys.Size),
-			})
-			if err != nil {
-				return nil // continue loop instead of retrying when size object not available
-			}
-			sizeData, err = io.ReadAll(outSize.Body)
-			if err != nil {
-				return err
-			}
-			err = outSize.Body.Close()
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-		if len(sizeData) != 0 {
+		sizeData, err := objects.Get(ctx, tailArgs.PullKeys.Size)
+		if err == nil && len(sizeData) != 0 { // otherwise size is not yet available
 			size, err := strconv.Atoi(string(sizeData))
 			if err != nil {
 				lib.Logger.Println("error:", err)
 				return 0, err
 			}
 			if rangeStart == size {
-				exitStr := ""
+				var exitData []byte
 				err := lib.Retry(ctx, func() error {
-					outExit, err := lib.S3Client().GetObject(ctx, &s3.GetObjectInput{
-						Bucket: aws.String(tailArgs.PullBucket),
-						Key:    aws.String(tailArgs.PullKeys.Exit),
-					})
-					if err != nil {
-						return err
-					}
-					exitData, err := io.ReadAll(outExit.Body)
-					if err != nil {
-						return err
-					}
-					err = outExit.Body.Close()
-					if err != nil {
-						return err
-					}
-					exitStr = string(exitData)
-					return nil
+					var err error
+					exitData, err = objects.Get(ctx, tailArgs.PullKeys.Exit)
+					return err
 				})
 				if err != nil {
 					lib.Logger.Println("error:", err)
 					return 0, err
 				}
-				exit, err := strconv.Atoi(string(exitStr))
+				exit, err := strconv.Atoi(string(exitData))
 				if err != nil {
 					lib.Logger.Println("error:", err)
 					return 0, err
@@ -354,27 +624,14 @@ func Tail(ctx context.Context, tailArgs *TailArgs) (int, error) {
 		}
 		// otherwize process log data for range-start
 		var data []byte
-		err := lib.Retry(ctx, func() error {
-			out, err := lib.S3Client().GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(tailArgs.PullBucket),
-				Key:    aws.String(tailArgs.PullKeys.Log),
-				Range:  aws.String(fmt.Sprintf("bytes=%d-", rangeStart)),
-			})
-			if err != nil {
-				if strings.Contains(err.Error(), "InvalidRange") {
-					time.Sleep(tailArgs.LogShipInterval)
-					return nil
-				}
-				if strings.Contains(err.Error(), "NoSuchKey") {
-					return nil
-				}
-				return err
-			}
-			data, err = io.ReadAll(out.Body)
-			if err != nil {
-				return err
+		err = lib.Retry(ctx, func() error {
+			var err error
+			data, err = objects.GetRange(ctx, tailArgs.PullKeys.Log, int64(rangeStart))
+			if errors.Is(err, store.ErrInvalidRange) || errors.Is(err, store.ErrNotFound) {
+				time.Sleep(tailArgs.LogShipInterval)
+				return nil
 			}
-			return nil
+			return err
 		})
 		if err != nil {
 			lib.Logger.Println("error:", err)
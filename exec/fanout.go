@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// a child job launched from an rpc via Fanout()
+type FanoutJob struct {
+	// to invoke subprocess, provide argv. this is slower.
+	Argv []string
+
+	// to invoke rpc, provide name and args. this is faster.
+	RpcName string
+	RpcArgs string
+}
+
+type FanoutResult struct {
+	Uid    string
+	Exit   int
+	Result string // set by the child via Result()
+}
+
+type fanoutFunc func(ctx context.Context, jobs []*FanoutJob, concurrency int) ([]*FanoutResult, error)
+
+type fanoutKey struct{}
+
+type resultKey struct{}
+
+// used by the backend to launch child jobs on behalf of rpc functions
+func WithFanout(ctx context.Context, fn fanoutFunc) context.Context {
+	return context.WithValue(ctx, fanoutKey{}, fn)
+}
+
+// launch child jobs from an rpc function with at most concurrency
+// running at once, streaming their logs into the parent log prefixed
+// by job index, and returning their exit codes and results in the
+// same order as jobs. a child exiting non-zero is not an error.
+func Fanout(ctx context.Context, jobs []*FanoutJob, concurrency int) ([]*FanoutResult, error) {
+	fn, ok := ctx.Value(fanoutKey{}).(fanoutFunc)
+	if !ok {
+		return nil, fmt.Errorf("fanout is only available to rpc functions invoked by the backend")
+	}
+	if concurrency <= 0 || concurrency > len(jobs) {
+		concurrency = len(jobs)
+	}
+	return fn(ctx, jobs, concurrency)
+}
+
+// used by the backend to receive results from rpc functions
+func WithResult(ctx context.Context, fn func(result string)) context.Context {
+	return context.WithValue(ctx, resultKey{}, fn)
+}
+
+// report a result from an rpc function. the result is persisted with
+// the job metadata and returned to a parent job via Fanout(). when
+// invoked outside of the backend, ie via the cli, this does nothing.
+func Result(ctx context.Context, result string) {
+	fn, ok := ctx.Value(resultKey{}).(func(result string))
+	if !ok {
+		return
+	}
+	fn(result)
+}
+
+// prefix each complete line of streamed log data, buffering partial
+// lines until they are complete or Flush() is called
+type LinePrefixer struct {
+	Prefix  string
+	Println func(line string)
+	buf     string
+}
+
+func (l *LinePrefixer) Write(data string) {
+	l.buf += data
+	for {
+		i := strings.Index(l.buf, "\n")
+		if i == -1 {
+			return
+		}
+		l.Println(l.Prefix + l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+}
+
+func (l *LinePrefixer) Flush() {
+	if l.buf != "" {
+		l.Println(l.Prefix + l.buf)
+		l.buf = ""
+	}
+}
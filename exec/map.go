@@ -0,0 +1,107 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nathants/libaws/lib"
+)
+
+const MapAttempts = 3
+
+type MapResult struct {
+	ArgsJson string
+	Uid      string
+	Exit     int
+	Duration time.Duration
+	Err      error // set when the job could not be run after retries
+}
+
+// invoke the rpc in baseArgs once per argsJson with at most concurrency
+// jobs running at once. log lines are prefixed by job index and passed
+// to baseArgs.LogDataCallback. a job is resubmitted only when
+// submission fails, since rpcs are not idempotent. once a job has a uid,
+// errors resume polling that uid. a job that exits non-zero is not
+// retried. results are in the same order as argsJson, and the returned
+// error is the first job error if any.
+func Map(ctx context.Context, baseArgs *Args, argsJson []string, concurrency int) ([]*MapResult, error) {
+	if concurrency <= 0 || concurrency > len(argsJson) {
+		concurrency = len(argsJson)
+	}
+	results := make([]*MapResult, len(argsJson))
+	logLock := &sync.Mutex{}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rpcArgs := range argsJson {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			result := &MapResult{
+				ArgsJson: rpcArgs,
+				Exit:     -1,
+			}
+			results[i] = result
+			start := time.Now()
+			rangeStart := 0
+			for attempt := 0; attempt < MapAttempts; attempt++ {
+				prefixer := &LinePrefixer{
+					Prefix: fmt.Sprintf("[%d] ", i),
+					Println: func(line string) {
+						if baseArgs.LogDataCallback != nil {
+							logLock.Lock()
+							baseArgs.LogDataCallback(line + "\n")
+							logLock.Unlock()
+						}
+					},
+				}
+				args := *baseArgs
+				args.RpcArgs = rpcArgs
+				args.ProgressCallback = nil
+				args.LogDataCallback = prefixer.Write
+				if result.Uid == "" {
+					result.Uid, result.Err = submitJob(ctx, &args)
+				}
+				if result.Uid != "" && args.PushUrls == nil {
+					result.Exit, result.Err = pollJob(ctx, &args, result.Uid, &rangeStart)
+				}
+				prefixer.Flush()
+				if result.Err == nil || ctx.Err() != nil || permanent(result.Err) {
+					break
+				}
+				lib.Logger.Println("retry:", i, result.Err)
+				time.Sleep(time.Duration(attempt+1) * time.Second)
+			}
+			result.Duration = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result.Err != nil {
+			return results, result.Err
+		}
+	}
+	return results, nil
+}
+
+// a table of uid, exit, and duration for each result
+func FormatMapResults(results []*MapResult) string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("%-5s %-50s %-5s %s", "job", "uid", "exit", "duration"))
+	for i, result := range results {
+		uid := result.Uid
+		if uid == "" {
+			uid = "-"
+		}
+		exit := fmt.Sprint(result.Exit)
+		if result.Err != nil {
+			exit = "error"
+		}
+		lines = append(lines, fmt.Sprintf("%-5d %-50s %-5s %s", i, uid, exit, result.Duration.Round(time.Millisecond)))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
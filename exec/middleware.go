@@ -0,0 +1,91 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/nathants/libaws/lib"
+)
+
+// an rpc invocation as seen by middleware
+type RpcCall struct {
+	Name     string
+	ArgsJson string
+	AuthName string
+	Uid      string
+	Println  func(v ...any)
+}
+
+type RpcHandler func(ctx context.Context, call *RpcCall) error
+
+type RpcMiddleware func(next RpcHandler) RpcHandler
+
+var rpcMiddleware []RpcMiddleware
+
+// register middleware applied around every rpc invocation, both async
+// via lambda and local via the cli. the first registered is outermost.
+func Use(middleware ...RpcMiddleware) {
+	rpcMiddleware = append(rpcMiddleware, middleware...)
+}
+
+// invoke a registered rpc through the middleware chain. panics are
+// always captured and returned as *RpcPanic, both from the rpc so
+// middleware can observe them, and from the middleware itself.
+func CallRpc(ctx context.Context, call *RpcCall) error {
+	handler := RecoverMiddleware(func(ctx context.Context, call *RpcCall) error {
+		fn, ok := Rpc[call.Name]
+		if !ok {
+			return fmt.Errorf("no such rpc: %s", call.Name)
+		}
+		return fn(ctx, call.Println, call.ArgsJson)
+	})
+	for i := len(rpcMiddleware) - 1; i >= 0; i-- {
+		handler = rpcMiddleware[i](handler)
+	}
+	return RecoverMiddleware(handler)(ctx, call)
+}
+
+// a panic recovered from an rpc
+type RpcPanic struct {
+	Value any
+	Stack string
+}
+
+func (p *RpcPanic) Error() string {
+	return fmt.Sprint(p.Value) + "\n" + p.Stack
+}
+
+// convert panics into *RpcPanic errors
+func RecoverMiddleware(next RpcHandler) RpcHandler {
+	return func(ctx context.Context, call *RpcCall) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &RpcPanic{
+					Value: r,
+					Stack: string(debug.Stack()),
+				}
+			}
+		}()
+		return next(ctx, call)
+	}
+}
+
+// log name, auth, uid, duration, and outcome of every rpc
+func TimingMiddleware(next RpcHandler) RpcHandler {
+	return func(ctx context.Context, call *RpcCall) error {
+		start := time.Now()
+		err := next(ctx, call)
+		outcome := "ok"
+		var rpcPanic *RpcPanic
+		if errors.As(err, &rpcPanic) {
+			outcome = "panic"
+		} else if err != nil {
+			outcome = "error"
+		}
+		lib.Logger.Println("rpc", call.Name, call.AuthName, call.Uid, time.Since(start), outcome)
+		return err
+	}
+}
@@ -0,0 +1,75 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+const progressBarWidth = 30
+
+// render job progress as a single line on a terminal, clearing it
+// around log output so the bar stays below the logs
+type ProgressBar struct {
+	lock     sync.Mutex
+	w        io.Writer
+	enabled  bool
+	progress *JobProgress
+}
+
+// a progress bar on stderr, disabled when stderr is not a terminal
+func NewProgressBar() *ProgressBar {
+	return &ProgressBar{
+		w:       os.Stderr,
+		enabled: isatty.IsTerminal(os.Stderr.Fd()),
+	}
+}
+
+func (p *ProgressBar) Update(progress *JobProgress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.progress = progress
+	p.draw()
+}
+
+// print log data via fn without colliding with the bar
+func (p *ProgressBar) Log(fn func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	fn()
+	p.draw()
+}
+
+// remove the bar, call before exit
+func (p *ProgressBar) Done() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	p.progress = nil
+}
+
+func (p *ProgressBar) clear() {
+	if p.enabled && p.progress != nil {
+		_, _ = fmt.Fprint(p.w, "\r\033[K")
+	}
+}
+
+func (p *ProgressBar) draw() {
+	if p.enabled && p.progress != nil {
+		_, _ = fmt.Fprint(p.w, "\r\033[K"+FormatProgress(p.progress))
+	}
+}
+
+func FormatProgress(progress *JobProgress) string {
+	filled := 0
+	if progress.Total > 0 {
+		filled = min(progressBarWidth, max(0, progressBarWidth*progress.Done/progress.Total))
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	return fmt.Sprintf("[%s] %d/%d %s", bar, progress.Done, progress.Total, progress.Message)
+}
@@ -12,8 +12,10 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.42.1
 	github.com/aws/aws-sdk-go-v2/service/lambda v1.71.1
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.79.1
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.38.4
 	github.com/dustin/go-humanize v1.0.1
 	github.com/gofrs/uuid v4.4.0+incompatible
+	github.com/mattn/go-isatty v0.0.20
 	github.com/nathants/libaws v0.0.0-20250407100805-9b4ba3cb5975
 	golang.org/x/crypto v0.37.0
 )
@@ -51,13 +53,11 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/route53 v1.51.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ses v1.30.2 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sns v1.34.3 // indirect
-	github.com/aws/aws-sdk-go-v2/service/sqs v1.38.4 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sso v1.25.3 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.30.1 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.33.18 // indirect
 	github.com/aws/smithy-go v1.22.2 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mikesmitty/edkey v0.0.0-20170222072505-3356ea4e686a // indirect
 	github.com/r3labs/diff/v2 v2.15.1 // indirect
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
@@ -8,16 +8,24 @@ import (
 	"sort"
 	"strings"
 
+	_ "github.com/nathants/aws-exec/cmd/audit"
 	_ "github.com/nathants/aws-exec/cmd/auth"
 	_ "github.com/nathants/aws-exec/cmd/exec"
 	_ "github.com/nathants/aws-exec/cmd/listdir"
 	_ "github.com/nathants/aws-exec/cmd/rpc"
+	_ "github.com/nathants/aws-exec/cmd/serve"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/nathants/aws-exec/backend"
+	"github.com/nathants/aws-exec/exec"
 	"github.com/nathants/libaws/lib"
 )
 
+func init() {
+	// middleware applied around every rpc, async and local
+	exec.Use(exec.TimingMiddleware)
+}
+
 func usage() {
 	var fns []string
 	maxLen := 0
@@ -36,6 +44,7 @@ func usage() {
 func main() {
 	// start lambda
 	if len(os.Args) == 1 {
+		backend.CheckConfig()
 		lambda.Start(backend.HandleRequest)
 		return
 	}
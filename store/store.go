@@ -0,0 +1,336 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nathants/libaws/lib"
+)
+
+// objects for jobs and logs, s3 in lambda and a directory in local mode
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader) error
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// from start to the end, ErrInvalidRange when start is not before the end
+	GetRange(ctx context.Context, key string, start int64) ([]byte, error)
+
+	// the size
+	Head(ctx context.Context, key string) (int64, error)
+
+	// keys, sorted
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// a url for http get with a range header
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+var (
+	ErrNotFound     = errors.New("object not found")
+	ErrInvalidRange = errors.New("invalid range")
+)
+
+// the keys of the objects of a job, shipped by the backend and read by
+// the api and Tail()
+type JobLayout struct {
+	AuthName string
+	Uid      string
+}
+
+func Job(authName, uid string) JobLayout {
+	return JobLayout{AuthName: authName, Uid: uid}
+}
+
+func (j JobLayout) Prefix() string {
+	return fmt.Sprintf("jobs/%s/%s/", j.AuthName, j.Uid)
+}
+
+// all stdout and stderr, updated in its entirety every second
+func (j JobLayout) Log() string {
+	return j.Prefix() + "log.txt"
+}
+
+// the exit code, written once
+func (j JobLayout) Exit() string {
+	return j.Prefix() + "exit"
+}
+
+// the size of the final log, written once and last
+func (j JobLayout) Size() string {
+	return j.Prefix() + "size"
+}
+
+// exec.JobMeta as json
+func (j JobLayout) Meta() string {
+	return j.Prefix() + "meta.json"
+}
+
+// service logs of the backend, shipped in batches
+func ServiceLog(unix int64, uid string, count int) string {
+	return fmt.Sprintf("logs/%d.%s.%03d", unix, uid, count)
+}
+
+// map s3 errors to ErrNotFound and ErrInvalidRange
+func s3Error(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case strings.Contains(err.Error(), "NoSuchKey"), strings.Contains(err.Error(), "NotFound"):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case strings.Contains(err.Error(), "InvalidRange"):
+		return fmt.Errorf("%w: %w", ErrInvalidRange, err)
+	default:
+		return err
+	}
+}
+
+type S3 struct {
+	Bucket string
+}
+
+func NewS3(bucket string) *S3 {
+	return &S3{Bucket: bucket}
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader) error {
+	_, err := lib.S3Client().PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.get(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+}
+
+func (s *S3) GetRange(ctx context.Context, key string, start int64) ([]byte, error) {
+	return s.get(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", start)),
+	})
+}
+
+func (s *S3) get(ctx context.Context, input *s3.GetObjectInput) ([]byte, error) {
+	out, err := lib.S3Client().GetObject(ctx, input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer func() { _ = out.Body.Close() }()
+	return io.ReadAll(out.Body)
+}
+
+func (s *S3) Head(ctx context.Context, key string) (int64, error) {
+	out, err := lib.S3Client().HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, s3Error(err)
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(lib.S3Client(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *S3) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(lib.S3Client()).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// objects as files under Root. presigned urls point at Url, where
+// ServeHTTP must be mounted at /_store/.
+type Dir struct {
+	Root   string
+	Url    string
+	secret []byte
+}
+
+func NewDir(root, url string) *Dir {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return &Dir{
+		Root:   root,
+		Url:    strings.TrimRight(url, "/"),
+		secret: secret,
+	}
+}
+
+func (d *Dir) path(key string) (string, error) {
+	path := filepath.Join(d.Root, filepath.FromSlash(key))
+	if key == "" || !strings.HasPrefix(path, filepath.Clean(d.Root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("bad key: %q", key)
+	}
+	return path, nil
+}
+
+// write to a temp file and rename, so readers never see a partial object
+func (d *Dir) Put(_ context.Context, key string, body io.Reader) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put.*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = io.Copy(f, body)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *Dir) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return data, err
+}
+
+func (d *Dir) GetRange(ctx context.Context, key string, start int64) ([]byte, error) {
+	data, err := d.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 || start >= int64(len(data)) {
+		return nil, fmt.Errorf("%w: %s bytes=%d-", ErrInvalidRange, key, start)
+	}
+	return data[start:], nil
+}
+
+func (d *Dir) Head(_ context.Context, key string) (int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d *Dir) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	root := filepath.Clean(d.Root)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".put.") {
+			return nil
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator)))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (d *Dir) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, d.secret)
+	_, _ = fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dir) Presign(_ context.Context, key string, expires time.Duration) (string, error) {
+	unix := time.Now().Add(expires).Unix()
+	return fmt.Sprintf("%s/_store/%s?expires=%d&signature=%s", d.Url, key, unix, d.sign(key, unix)), nil
+}
+
+// serve presigned urls with range support. like s3 without list
+// permission, missing objects are 403.
+func (d *Dir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/_store/")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(d.sign(key, expires))) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	path, err := d.path(key)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}